@@ -1,121 +1,401 @@
 package cmd
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 
+	"github.com/denysvitali/id-watermark/internal/config"
 	"github.com/denysvitali/id-watermark/pkg/watermark"
 )
 
 var batchCmd = &cobra.Command{
-	Use:   "batch [input-dir] [output-dir]",
+	Use:   "batch [input-dir] [output-dir] | batch --jobs manifest",
 	Short: "Process multiple images in a directory",
 	Long: `Process multiple images in a directory by adding watermarks.
 	
-Example:
-  id-watermark batch ./images ./watermarked --company "ACME Corp" --workers 8 --recursive`,
-	Args: cobra.ExactArgs(2),
-	RunE: runBatch,
+Files processed before are recorded in ` + watermark.StateFile + ` in the
+output directory. When a batch is run again, files whose input and settings
+are unchanged are skipped, so an interrupted batch resumes where it stopped.
+Use --force to reprocess every file.
+
+Images are searched in the input directory, and in its subdirectories with
+--recursive. --include and --exclude select files with globs matched against
+their path relative to the input directory, where ** matches any number of
+directories; a pattern without a slash matches the name only, and excluded
+directories are not searched. Symlinks are skipped unless --follow-symlinks
+is given. With --files-from, the files are read from a list, or from stdin
+for -, with one path per line relative to the working directory, as find
+prints them. Every listed file must be inside the input directory.
+
+Outputs mirror the input tree with the names of the inputs. --name-template
+names them with the placeholders {stem}, {ext}, {date}, {company} and
+{hash8}, the first 8 hex digits of the SHA-256 hash of the input; names
+without an image extension get the extension of the output. --layout
+flatten writes every output directly to the output directory, and
+--output-format converts every output to jpeg or png. Outputs that would
+get the same name are numbered, as in photo_1.jpg.
+
+--memory-budget limits the memory of the images processed at once, as
+estimated from their dimensions, so a few very large scans do not run out
+of memory while small images still run in parallel.
+
+A ` + watermark.DirConfigFile + ` file in the input directory or any
+subdirectory overrides the settings for the images below it, with nearer
+files taking precedence. It accepts the keys of the config file except
+profiles, and the policy still applies.
+
+With --jobs, the images are listed in a CSV or JSON manifest instead. Each
+entry has an input and an output path, relative to the working directory,
+and its own settings such as company, purpose, recipient or opacity, named
+like the keys of the config file. A CSV manifest has a header row naming
+its columns; empty cells keep the other settings. Entries with an output
+already used by an earlier entry fail.
+
+Examples:
+  id-watermark batch ./images ./watermarked --company "ACME Corp" --workers 8 --recursive
+  id-watermark batch ./scans ./out -r --exclude '*_thumb.jpg' --exclude .git --max-depth 2
+  id-watermark batch ./scans ./out -r --layout flatten --name-template '{stem}_wm_{date}{ext}' --output-format jpeg
+  find ./scans -newer last-run | id-watermark batch ./scans ./out --files-from -
+  id-watermark batch --jobs jobs.csv --purpose "Rental application"`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if jobs, _ := cmd.Flags().GetString("jobs"); jobs == "" {
+			return cobra.ExactArgs(2)(cmd, args)
+		}
+		if len(args) > 0 {
+			return fmt.Errorf("--jobs lists the input and output of every image, so no directories can be given")
+		}
+		return nil
+	},
+	RunE:         runBatch,
+	SilenceUsage: true,
 }
 
 func init() {
 	rootCmd.AddCommand(batchCmd)
 
-	// Required flags
-	batchCmd.Flags().StringP("company", "c", "", "company name for watermark (required)")
-	batchCmd.MarkFlagRequired("company")
-
-	// Optional flags
-	batchCmd.Flags().StringP("font", "f", "", "path to TTF font file")
-	batchCmd.Flags().Float64P("size", "s", 0, "font size for watermark (10-200)")
+	batchCmd.Flags().StringP("company", "c", "", "company name for watermark (required unless set in the config)")
+	batchCmd.Flags().String("purpose", "", "what the document is shared for, shown in the watermark text")
+	batchCmd.Flags().String("recipient", "", "who the document is shared with, shown in the watermark text")
+	batchCmd.Flags().Bool("forensic-mark", false, "add an identifier unique to every output to the watermark text")
+	batchCmd.Flags().StringP("font", "f", "", "path to TTF/OTF font file or collection face (file.ttc#2), family name such as \"DejaVu Sans:bold\", or builtin:<sans|sans-bold|serif|mono>")
+	batchCmd.Flags().StringArray("fallback-font", nil, "font tried for characters the main font lacks, in the same forms as --font (repeatable)")
+	batchCmd.Flags().StringP("size", "s", "", "font size for watermark: points (10-200), percent of the image diagonal (2%), percent of the width (2%w) or millimetres (5mm)")
 	batchCmd.Flags().Uint8P("opacity", "o", 0, "watermark opacity (0-255)")
-	batchCmd.Flags().Float64P("text-spacing", "x", 0, "horizontal spacing between watermarks")
-	batchCmd.Flags().Float64P("line-spacing", "y", 0, "vertical spacing between watermark lines")
+	batchCmd.Flags().StringP("text-spacing", "x", "", "horizontal spacing between watermarks, in the same units as --size")
+	batchCmd.Flags().StringP("line-spacing", "y", "", "vertical spacing between watermark lines, in the same units as --size")
 	batchCmd.Flags().IntP("quality", "q", 0, "JPEG output quality (1-100)")
+	batchCmd.Flags().String("color", "", "watermark text color: #RRGGBB, #RRGGBBAA, a CSS color name or rgba(r, g, b, a); without alpha, --opacity applies")
+	batchCmd.Flags().String("stroke-color", "", "color of an outline around the watermark text, in the same forms as --color")
+	batchCmd.Flags().String("background-color", "", "color of a band behind each watermark line, in the same forms as --color")
+	batchCmd.Flags().Bool("detect-document", false, "detect the document, correct its perspective and crop to it before watermarking; images without one are watermarked whole")
+	batchCmd.Flags().Bool("debug-outline", false, "save a copy of the input with the detected document outline drawn on it")
+	batchCmd.Flags().Int("max-dimension", 0, "downscale so the longest side is at most this many pixels")
+	batchCmd.Flags().Float64("target-dpi", 0, "downscale so the resolution is at most this DPI (when the input DPI is known)")
+	batchCmd.Flags().StringArray("redact", nil, "region to redact before watermarking as x,y,width,height[:fill|pixelate|blur] (repeatable)")
 
 	// Batch-specific flags
 	batchCmd.Flags().IntP("workers", "w", 0, "number of parallel workers")
+	batchCmd.Flags().String("memory-budget", "", "memory the images processed at once may use, such as 4GB; large images wait for others to finish (default no limit)")
 	batchCmd.Flags().BoolP("recursive", "r", false, "process subdirectories recursively")
-
-	// Bind flags to viper
-	viper.BindPFlag("company", batchCmd.Flags().Lookup("company"))
-	viper.BindPFlag("font_path", batchCmd.Flags().Lookup("font"))
-	viper.BindPFlag("font_size", batchCmd.Flags().Lookup("size"))
-	viper.BindPFlag("opacity", batchCmd.Flags().Lookup("opacity"))
-	viper.BindPFlag("text_spacing", batchCmd.Flags().Lookup("text-spacing"))
-	viper.BindPFlag("line_spacing", batchCmd.Flags().Lookup("line-spacing"))
-	viper.BindPFlag("quality", batchCmd.Flags().Lookup("quality"))
-	viper.BindPFlag("workers", batchCmd.Flags().Lookup("workers"))
-	viper.BindPFlag("recursive", batchCmd.Flags().Lookup("recursive"))
+	batchCmd.Flags().Bool("force", false, "reprocess files that are unchanged since the last run")
+	batchCmd.Flags().StringArray("include", nil, "only process files matching this glob, such as '**/*.jpg' or 'id_*' (repeatable)")
+	batchCmd.Flags().StringArray("exclude", nil, "skip files and directories matching this glob, such as '*_thumb.jpg' or .git (repeatable)")
+	batchCmd.Flags().Int("max-depth", 0, "with --recursive, search at most this many directory levels, where 1 is the input directory only")
+	batchCmd.Flags().Bool("follow-symlinks", false, "follow symlinks to files and directories instead of skipping them")
+	batchCmd.Flags().String("name-template", watermark.DefaultNameTemplate, "name of every output, with the placeholders {stem}, {ext}, {date}, {company} and {hash8}")
+	batchCmd.Flags().String("layout", string(watermark.LayoutMirror), "arrangement of the outputs: mirror the input tree, or flatten into the output directory")
+	batchCmd.Flags().String("output-format", "", "convert every output to this format: jpeg or png (default the format of the input)")
+	batchCmd.Flags().String("files-from", "", "process the files listed in this file, one per line, or - for stdin, instead of searching the input directory")
+	batchCmd.Flags().String("events", "", "write an event for every file started, finished or failed in the given format (ndjson)")
+	batchCmd.Flags().String("events-output", "-", "file the events are written to, or - for stdout")
+	batchCmd.Flags().String("report", "", "write a report of every file, with hashes, dimensions, durations, watermark parameters and errors (.json, .csv or JUnit .xml)")
+	batchCmd.Flags().String("report-format", "", "format of --report: json, csv or junit (default from the file extension)")
+	batchCmd.Flags().String("jobs", "", "CSV or JSON manifest listing the input, output and settings of every image, instead of input and output directories")
 }
 
 func runBatch(cmd *cobra.Command, args []string) error {
-	inputDir := args[0]
-	outputDir := args[1]
-	companyName := viper.GetString("company")
-
-	logger.WithField("input_dir", inputDir).WithField("output_dir", outputDir).Info("Starting batch processing")
-
-	// Create overrides map for any provided flags
-	overrides := make(map[string]interface{})
+	debugOutline, _ := cmd.Flags().GetBool("debug-outline")
+	recursive, _ := cmd.Flags().GetBool("recursive")
+	force, _ := cmd.Flags().GetBool("force")
+	manifest, _ := cmd.Flags().GetString("jobs")
+	include, _ := cmd.Flags().GetStringArray("include")
+	exclude, _ := cmd.Flags().GetStringArray("exclude")
+	maxDepth, _ := cmd.Flags().GetInt("max-depth")
+	followSymlinks, _ := cmd.Flags().GetBool("follow-symlinks")
+	filesFrom, _ := cmd.Flags().GetString("files-from")
+	nameTemplate, _ := cmd.Flags().GetString("name-template")
+	layout, _ := cmd.Flags().GetString("layout")
+	outputFormat, _ := cmd.Flags().GetString("output-format")
 
-	if cmd.Flags().Changed("size") {
-		overrides["font_size"] = viper.GetFloat64("font_size")
+	if maxDepth < 0 {
+		return fmt.Errorf("--max-depth must not be negative")
 	}
-	if cmd.Flags().Changed("opacity") {
-		overrides["opacity"] = viper.GetInt("opacity")
+	if maxDepth > 0 && !recursive {
+		return fmt.Errorf("--max-depth requires --recursive")
 	}
-	if cmd.Flags().Changed("text-spacing") {
-		overrides["text_spacing"] = viper.GetFloat64("text_spacing")
+	if manifest != "" {
+		for _, flag := range []string{"include", "exclude", "max-depth", "follow-symlinks", "files-from", "name-template", "layout", "output-format"} {
+			if cmd.Flags().Changed(flag) {
+				return fmt.Errorf("--%s applies to input and output directories, so it cannot be used with --jobs", flag)
+			}
+		}
 	}
-	if cmd.Flags().Changed("line-spacing") {
-		overrides["line_spacing"] = viper.GetFloat64("line_spacing")
+
+	// Follow the batch with an event stream and, on a terminal, a progress line
+	var handlers []watermark.EventFunc
+	var events *eventWriter
+	if format, _ := cmd.Flags().GetString("events"); format != "" {
+		path, _ := cmd.Flags().GetString("events-output")
+		var err error
+		if events, err = newEventWriter(format, path); err != nil {
+			return err
+		}
+		defer events.close()
+		handlers = append(handlers, events.write)
 	}
-	if cmd.Flags().Changed("quality") {
-		overrides["quality"] = viper.GetInt("quality")
+
+	// The report is written at the end, but its format and file are checked
+	// now so a typo does not lose the report of a long batch
+	var reportFile *reportWriter
+	if reportPath, _ := cmd.Flags().GetString("report"); reportPath != "" {
+		format, _ := cmd.Flags().GetString("report-format")
+		var err error
+		if reportFile, err = newReportWriter(reportPath, format); err != nil {
+			return err
+		}
+		defer reportFile.abort()
 	}
 
-	// Create watermark config
-	config, err := configMgr.CreateWatermarkConfig(companyName, viper.GetString("font_path"), overrides)
-	if err != nil {
-		return fmt.Errorf("creating watermark config: %w", err)
+	var bar *progress
+	if isTerminal(os.Stderr) && logger.Out == os.Stderr {
+		bar = newProgress(os.Stderr)
+		logger.SetOutput(bar)
+		defer logger.SetOutput(os.Stderr)
+		handlers = append(handlers, bar.update)
 	}
 
-	// Get batch options
-	workers := viper.GetInt("workers")
-	if workers == 0 {
-		workers = configMgr.GetAppConfig().DefaultWorkers
+	memoryBudget, err := watermark.ParseByteSize(configMgr.GetAppConfig().MemoryBudget)
+	if err != nil {
+		return fmt.Errorf("invalid memory budget: %w", err)
 	}
 
+	// Get batch options
 	batchOptions := &watermark.BatchOptions{
-		Workers:   workers,
-		Recursive: viper.GetBool("recursive"),
-		Logger:    logger,
+		Workers:        configMgr.GetAppConfig().DefaultWorkers,
+		MemoryBudget:   memoryBudget,
+		Recursive:      recursive,
+		Force:          force,
+		Include:        include,
+		Exclude:        exclude,
+		MaxDepth:       maxDepth,
+		FollowSymlinks: followSymlinks,
+		NameTemplate:   nameTemplate,
+		Layout:         watermark.Layout(layout),
+		Format:         outputFormat,
+		Logger:         logger,
+		DirConfig:      dirWatermarkConfig(debugOutline),
+		OnEvent: func(event watermark.Event) {
+			for _, handle := range handlers {
+				handle(event)
+			}
+		},
 	}
 
-	// Create batch processor
-	batchProcessor, err := watermark.NewBatchProcessor(config, batchOptions)
-	if err != nil {
-		return fmt.Errorf("creating batch processor: %w", err)
+	// An interrupted batch still reports the files it processed
+	var result *watermark.BatchResult
+	var batchErr error
+	if manifest != "" {
+		logger.WithField("manifest", manifest).Info("Starting batch processing")
+
+		jobs, err := manifestJobs(manifest, debugOutline)
+		if err != nil {
+			return err
+		}
+
+		// Every job creates its own config, so there is no shared one
+		batchProcessor, err := watermark.NewBatchProcessor(nil, batchOptions)
+		if err != nil {
+			return fmt.Errorf("creating batch processor: %w", err)
+		}
+
+		result, err = batchProcessor.ProcessJobs(cmd.Context(), jobs)
+		if result == nil {
+			return fmt.Errorf("processing jobs: %w", err)
+		}
+		batchErr = err
+	} else {
+		inputDir := args[0]
+		outputDir := args[1]
+
+		logger.WithField("input_dir", inputDir).WithField("output_dir", outputDir).Info("Starting batch processing")
+
+		// Create watermark config
+		config, err := configMgr.CreateWatermarkConfig(nil)
+		if err != nil {
+			return fmt.Errorf("creating watermark config: %w", err)
+		}
+		config.DebugOutline = debugOutline
+
+		// Create batch processor
+		batchProcessor, err := watermark.NewBatchProcessor(config, batchOptions)
+		if err != nil {
+			return fmt.Errorf("creating batch processor: %w", err)
+		}
+
+		// Process the listed files, or the directory
+		if filesFrom != "" {
+			files, listErr := readFileList(filesFrom)
+			if listErr != nil {
+				return listErr
+			}
+			result, err = batchProcessor.ProcessFileList(cmd.Context(), inputDir, outputDir, files)
+		} else {
+			result, err = batchProcessor.ProcessDirectory(cmd.Context(), inputDir, outputDir)
+		}
+		if result == nil {
+			return fmt.Errorf("processing directory: %w", err)
+		}
+		batchErr = err
 	}
 
-	// Process directory
-	result, err := batchProcessor.ProcessDirectory(inputDir, outputDir)
-	if err != nil {
-		return fmt.Errorf("processing directory: %w", err)
+	if bar != nil {
+		bar.finish()
 	}
 
 	// Report results
+	for _, file := range result.Files {
+		if len(file.Overrides) > 0 {
+			logger.WithFields(logrus.Fields{
+				"file":      file.InputPath,
+				"overrides": strings.Join(file.Overrides, ", "),
+			}).Info("Applied directory config")
+		}
+		if file.Mark != "" {
+			logger.WithFields(logrus.Fields{
+				"file":   file.InputPath,
+				"output": file.OutputPath,
+				"mark":   file.Mark,
+			}).Info("Applied forensic mark")
+		}
+		if file.OriginalSize != file.FinalSize {
+			logger.WithFields(logrus.Fields{
+				"file":          file.InputPath,
+				"original_size": file.OriginalSize,
+				"final_size":    file.FinalSize,
+			}).Info("Resized image")
+		}
+	}
+
+	if result.CanceledCount > 0 {
+		logger.Warnf("Interrupted with %d of %d files not processed", result.CanceledCount, result.TotalCount)
+	}
 	if result.ErrorCount > 0 {
 		logger.Warnf("Completed with %d errors out of %d files", result.ErrorCount, result.TotalCount)
 		for _, batchErr := range result.Errors {
-			logger.WithError(batchErr.Error).WithField("file", batchErr.FilePath).Error("Processing failed")
+			entry := logger.WithError(batchErr.Error).WithField("file", batchErr.FilePath)
+			if len(batchErr.Overrides) > 0 {
+				entry = entry.WithField("overrides", strings.Join(batchErr.Overrides, ", "))
+			}
+			entry.Error("Processing failed")
 		}
+	} else if result.SkippedCount > 0 {
+		logger.Infof("Successfully processed %d files, skipped %d unchanged files", result.SuccessCount, result.SkippedCount)
 	} else {
 		logger.Infof("Successfully processed all %d files", result.SuccessCount)
 	}
 
-	return nil
+	if reportFile != nil {
+		if err := reportFile.writeReport(newReport(result)); err != nil {
+			return err
+		}
+		logger.WithField("report", reportFile.path).Info("Wrote batch report")
+	}
+
+	if events != nil {
+		if err := events.close(); err != nil {
+			return err
+		}
+	}
+
+	return batchErr
+}
+
+// readFileList reads a list of files, one per line, from a file or from
+// stdin for "-". Empty lines are ignored.
+func readFileList(path string) ([]string, error) {
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("opening file list: %w", err)
+		}
+		defer file.Close()
+		in = file
+	}
+
+	var files []string
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); strings.TrimSpace(line) != "" {
+			files = append(files, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading file list: %w", err)
+	}
+	return files, nil
+}
+
+// dirWatermarkConfig creates watermark configs for directories with a
+// directory config file, merged over the effective settings
+func dirWatermarkConfig(debugOutline bool) watermark.DirConfigFunc {
+	return func(files []string) (*watermark.Config, error) {
+		overrides, err := config.LoadDirConfig(files)
+		if err != nil {
+			return nil, err
+		}
+
+		dirConfig, err := configMgr.CreateWatermarkConfig(overrides)
+		if err != nil {
+			return nil, err
+		}
+		dirConfig.DebugOutline = debugOutline
+		return dirConfig, nil
+	}
+}
+
+// manifestJobs loads the jobs of a manifest. Every job creates its config
+// from its settings, and invalid entries are reported as failed jobs.
+func manifestJobs(manifest string, debugOutline bool) ([]watermark.Job, error) {
+	entries, err := config.LoadManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]watermark.Job, 0, len(entries))
+	for _, entry := range entries {
+		jobs = append(jobs, watermark.Job{
+			InputPath:  entry.Input,
+			OutputPath: entry.Output,
+			Config: func() (*watermark.Config, error) {
+				if entry.Err != nil {
+					return nil, entry.Err
+				}
+
+				jobConfig, err := configMgr.CreateWatermarkConfig(entry.Overrides)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %w", manifest, entry.Line, err)
+				}
+				jobConfig.DebugOutline = debugOutline
+				return jobConfig, nil
+			},
+		})
+	}
+	return jobs, nil
 }
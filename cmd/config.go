@@ -1,11 +1,18 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
 
 	"github.com/denysvitali/id-watermark/internal/config"
+	"github.com/denysvitali/id-watermark/pkg/watermark"
 )
 
 var configCmd = &cobra.Command{
@@ -29,14 +36,106 @@ Example:
 var showConfigCmd = &cobra.Command{
 	Use:   "show",
 	Short: "Show current configuration",
-	Long:  `Display the current configuration values.`,
-	RunE:  runShowConfig,
+	Long: `Display the effective configuration values and where each one comes
+from: default, file, preset, env or flag. Later sources take precedence in
+that order. Constraints of the system policy file (` + config.DefaultPolicyPath + `),
+which no source can weaken, are listed as well.
+
+With --preset, the values are shown after merging the named profile.
+
+Example:
+  id-watermark config show --preset bank-kyc
+  id-watermark config show --json`,
+	RunE: runShowConfig,
+}
+
+var validateConfigCmd = &cobra.Command{
+	Use:   "validate [filename]",
+	Short: "Validate a configuration file",
+	Long: `Strictly check a configuration file and report every problem with its
+file, line and key. Unknown keys, values of the wrong type or out of range,
+and font paths that do not exist are all reported.
+
+Without a filename, the configuration file in use is validated.
+
+Example:
+  id-watermark config validate config.yaml`,
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	RunE:         runValidateConfig,
+}
+
+var getConfigCmd = &cobra.Command{
+	Use:   "get <key>",
+	Short: "Print the effective value of a configuration key",
+	Long: `Print the value of a single configuration key, after defaults, the config
+file, the preset and environment variables are applied. Nested keys are
+separated by dots.
+
+Example:
+  id-watermark config get opacity
+  id-watermark config get watermark_color
+  id-watermark config get profiles.bank-kyc.opacity`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         runGetConfig,
+}
+
+var setConfigCmd = &cobra.Command{
+	Use:   "set <key> <value>...",
+	Short: "Set a configuration key in the config file",
+	Long: `Set a single key in the config file, creating the file if needed. Values
+are checked like config validate does, and the file's comments and key
+order are kept.
+
+List settings take one argument per element, and redactions are given as
+"x,y,width,height[:mode]". The r, g, b and a channels of a color can be set
+on their own, keeping the form the color is given in.
+
+The file in use is edited, or the default config file when there is none.
+
+Example:
+  id-watermark config set opacity 60
+  id-watermark config set watermark_color "#c80000"
+  id-watermark config set watermark_color.a 128
+  id-watermark config set fallback_fonts "Noto Sans" builtin:sans
+  id-watermark config set profiles.bank-kyc.text_template "{company} - KYC only - {date}"`,
+	Args:         cobra.MinimumNArgs(2),
+	SilenceUsage: true,
+	RunE:         runSetConfig,
+}
+
+var unsetConfigCmd = &cobra.Command{
+	Use:   "unset <key>",
+	Short: "Remove a configuration key from the config file",
+	Long: `Remove a single key from the config file, so its default applies again.
+Sections left empty are removed as well.
+
+Example:
+  id-watermark config unset profiles.bank-kyc.opacity`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         runUnsetConfig,
 }
 
 func init() {
 	rootCmd.AddCommand(configCmd)
 	configCmd.AddCommand(generateConfigCmd)
 	configCmd.AddCommand(showConfigCmd)
+	configCmd.AddCommand(validateConfigCmd)
+	configCmd.AddCommand(getConfigCmd)
+	configCmd.AddCommand(setConfigCmd)
+	configCmd.AddCommand(unsetConfigCmd)
+
+	showConfigCmd.Flags().Bool("json", false, "print the configuration as JSON")
+}
+
+// editedConfigFile returns the config file changed by config set and unset
+func editedConfigFile() string {
+	if filename := configMgr.ConfigFileUsed(); filename != "" {
+		return filename
+	}
+	return config.GetDefaultConfigPath()
 }
 
 func runGenerateConfig(cmd *cobra.Command, args []string) error {
@@ -57,27 +156,175 @@ func runGenerateConfig(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func runValidateConfig(cmd *cobra.Command, args []string) error {
+	var filename string
+	if len(args) > 0 {
+		filename = args[0]
+	} else if filename = configMgr.ConfigFileUsed(); filename == "" {
+		return fmt.Errorf("no configuration file found, pass the file to validate")
+	}
+
+	problems, err := config.ValidateFile(filename)
+	if err != nil {
+		return fmt.Errorf("validating config file: %w", err)
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s: found %d problem(s)", filename, len(problems))
+	}
+
+	fmt.Printf("%s: configuration is valid\n", filename)
+	return nil
+}
+
+func runGetConfig(cmd *cobra.Command, args []string) error {
+	value, err := configMgr.Get(args[0])
+	if err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case []interface{}, []string, map[string]interface{}:
+		out, err := yaml.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("formatting value: %w", err)
+		}
+		fmt.Print(string(out))
+	default:
+		fmt.Println(v)
+	}
+
+	return nil
+}
+
+func runSetConfig(cmd *cobra.Command, args []string) error {
+	filename := editedConfigFile()
+	if err := config.SetValue(filename, args[0], args[1:]); err != nil {
+		return err
+	}
+
+	logger.WithField("file", filename).Debugf("Set %s", args[0])
+	return nil
+}
+
+func runUnsetConfig(cmd *cobra.Command, args []string) error {
+	filename := editedConfigFile()
+	if err := config.UnsetValue(filename, args[0]); err != nil {
+		return err
+	}
+
+	logger.WithField("file", filename).Debugf("Unset %s", args[0])
+	return nil
+}
+
+// shownConfig is the JSON output of config show
+type shownConfig struct {
+	ConfigFile   string           `json:"config_file"`
+	Preset       string           `json:"preset,omitempty"`
+	Policy       *config.Policy   `json:"policy,omitempty"`
+	Settings     []config.Setting `json:"settings"`
+	Presets      []string         `json:"presets"`
+	BuiltinFonts []string         `json:"builtin_fonts"`
+}
+
 func runShowConfig(cmd *cobra.Command, args []string) error {
 	appConfig := configMgr.GetAppConfig()
 
-	fmt.Printf("Current Configuration:\n")
-	fmt.Printf("  Font Path:         %s\n", appConfig.FontPath)
-	fmt.Printf("  Font Size:         %.1f\n", appConfig.FontSize)
-	fmt.Printf("  Opacity:           %d\n", appConfig.Opacity)
-	fmt.Printf("  Text Spacing:      %.1f\n", appConfig.TextSpacing)
-	fmt.Printf("  Line Spacing:      %.1f\n", appConfig.LineSpacing)
-	fmt.Printf("  Quality:           %d\n", appConfig.Quality)
-	fmt.Printf("  Log Level:         %s\n", appConfig.LogLevel)
-	fmt.Printf("  Default Workers:   %d\n", appConfig.DefaultWorkers)
-	fmt.Printf("  Watermark Color:   RGB(%d, %d, %d)\n",
-		appConfig.WatermarkColor.R,
-		appConfig.WatermarkColor.G,
-		appConfig.WatermarkColor.B)
-
-	fmt.Printf("\nSystem Font Paths:\n")
-	for _, path := range appConfig.SystemFontPaths {
-		fmt.Printf("  - %s\n", path)
+	presets := make([]string, 0, len(appConfig.Profiles))
+	for name := range appConfig.Profiles {
+		presets = append(presets, name)
+	}
+	sort.Strings(presets)
+
+	builtinFonts := make([]string, 0)
+	for _, name := range watermark.BuiltinFontNames() {
+		builtinFonts = append(builtinFonts, watermark.BuiltinPrefix+name)
+	}
+
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(shownConfig{
+			ConfigFile:   configMgr.ConfigFileUsed(),
+			Preset:       configMgr.Preset(),
+			Policy:       configMgr.Policy(),
+			Settings:     configMgr.Settings(),
+			Presets:      presets,
+			BuiltinFonts: builtinFonts,
+		})
+	}
+
+	configFile := configMgr.ConfigFileUsed()
+	if configFile == "" {
+		configFile = "(none)"
+	}
+	fmt.Printf("Config File:  %s\n", configFile)
+	if preset := configMgr.Preset(); preset != "" {
+		fmt.Printf("Preset:       %s\n", preset)
+	}
+
+	fmt.Printf("\nCurrent Configuration:\n")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "  KEY\tSOURCE\tVALUE\n")
+	for _, setting := range configMgr.Settings() {
+		source := string(setting.Source)
+		if setting.EnvVar != "" {
+			source += " (" + setting.EnvVar + ")"
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", setting.Key, source, formatSetting(setting.Key, setting.Value, appConfig))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if policy := configMgr.Policy(); policy != nil {
+		fmt.Printf("\nPolicy Constraints (%s):\n", policy.Path)
+		for _, constraint := range policy.Constraints() {
+			fmt.Printf("  - %s\n", constraint)
+		}
+	}
+
+	if len(presets) > 0 {
+		fmt.Printf("\nAvailable Presets:\n")
+		for _, name := range presets {
+			fmt.Printf("  - %s\n", name)
+		}
+	}
+
+	fmt.Printf("\nBuiltin Fonts:\n")
+	for _, name := range builtinFonts {
+		fmt.Printf("  - %s\n", name)
 	}
 
 	return nil
 }
+
+// formatSetting formats an effective value on a single line
+func formatSetting(key string, value interface{}, appConfig *config.AppConfig) string {
+	if key == "redactions" {
+		regions := make([]string, 0, len(appConfig.Redactions))
+		for _, r := range appConfig.Redactions {
+			regions = append(regions, fmt.Sprintf("%dx%d at (%d, %d) %s", r.Width, r.Height, r.X, r.Y, r.Mode))
+		}
+		return strings.Join(regions, "; ")
+	}
+
+	switch v := value.(type) {
+	case []string:
+		return strings.Join(v, ", ")
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ", ")
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/denysvitali/id-watermark/pkg/watermark"
+)
+
+// eventRecord is a batch event as written to the event stream
+type eventRecord struct {
+	Event       watermark.EventType `json:"event"`
+	Time        time.Time           `json:"time"`
+	File        string              `json:"file"`
+	Output      string              `json:"output,omitempty"`
+	Total       int                 `json:"total"`
+	DurationMS  float64             `json:"duration_ms,omitempty"`
+	InputBytes  int64               `json:"input_bytes,omitempty"`
+	OutputBytes int64               `json:"output_bytes,omitempty"`
+	Error       string              `json:"error,omitempty"`
+}
+
+// eventWriter writes batch events as newline-delimited JSON
+type eventWriter struct {
+	encoder *json.Encoder
+	closer  io.Closer
+	err     error
+}
+
+// newEventWriter creates an event stream in the given format, written to a
+// file or to stdout for "-"
+func newEventWriter(format, path string) (*eventWriter, error) {
+	if format != "ndjson" {
+		return nil, fmt.Errorf("unsupported event format %q (expected ndjson)", format)
+	}
+
+	if path == "" || path == "-" {
+		return &eventWriter{encoder: json.NewEncoder(os.Stdout)}, nil
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("creating event file: %w", err)
+	}
+	return &eventWriter{encoder: json.NewEncoder(file), closer: file}, nil
+}
+
+// write writes an event. The first error is kept and returned by close, so
+// a failing stream does not interrupt the batch.
+func (w *eventWriter) write(event watermark.Event) {
+	if w.err != nil {
+		return
+	}
+
+	record := eventRecord{
+		Event:       event.Type,
+		Time:        event.Time,
+		File:        event.InputPath,
+		Output:      event.OutputPath,
+		Total:       event.Total,
+		DurationMS:  float64(event.Duration) / float64(time.Millisecond),
+		InputBytes:  event.InputBytes,
+		OutputBytes: event.OutputBytes,
+	}
+	if event.Err != nil {
+		record.Error = event.Err.Error()
+	}
+
+	if err := w.encoder.Encode(record); err != nil {
+		w.err = fmt.Errorf("writing event: %w", err)
+	}
+}
+
+// close closes the event file and returns the first error. It may be
+// called more than once.
+func (w *eventWriter) close() error {
+	if w.closer != nil {
+		if err := w.closer.Close(); err != nil && w.err == nil {
+			w.err = fmt.Errorf("closing event file: %w", err)
+		}
+		w.closer = nil
+	}
+	return w.err
+}
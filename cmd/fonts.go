@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/image/font/opentype"
+
+	"github.com/denysvitali/id-watermark/pkg/watermark"
+)
+
+var fontsCmd = &cobra.Command{
+	Use:   "fonts",
+	Short: "Font discovery",
+	Long:  `Inspect the fonts available to the ID watermark tool.`,
+}
+
+var listFontsCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List available fonts",
+	Long: `List the fonts found in the standard font directories, the XDG user font
+directory and any configured font_dirs, along with the builtin fonts.
+
+Coverage shows how many of the characters in the watermark text each font can render,
+with the text template, company, purpose and recipient of the effective settings.
+Any listed family can be used with --font "Family[:style]".
+
+Example:
+  id-watermark fonts list --company "ACME Corp"
+  id-watermark process in.jpg out.jpg --company "ACME Corp" --font "DejaVu Sans:bold"`,
+	Args: cobra.NoArgs,
+	RunE: runListFonts,
+}
+
+func init() {
+	rootCmd.AddCommand(fontsCmd)
+	fontsCmd.AddCommand(listFontsCmd)
+
+	listFontsCmd.Flags().StringP("company", "c", "", "company name used to compute glyph coverage")
+	listFontsCmd.Flags().String("purpose", "", "purpose used to compute glyph coverage")
+	listFontsCmd.Flags().String("recipient", "", "recipient used to compute glyph coverage")
+	listFontsCmd.Flags().String("family", "", "only list fonts whose family contains this text")
+}
+
+func runListFonts(cmd *cobra.Command, args []string) error {
+	familyFilter, _ := cmd.Flags().GetString("family")
+
+	// Coverage is computed for the text as it is drawn
+	config, err := configMgr.CreateWatermarkConfig(nil)
+	if err != nil {
+		return fmt.Errorf("creating watermark config: %w", err)
+	}
+	text := config.DisplayText()
+	fontManager := configMgr.NewFontManager()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "FAMILY\tSTYLE\tWEIGHT\tCOVERAGE\tPATH\n")
+
+	for _, info := range fontManager.ScanFonts() {
+		if familyFilter != "" && !strings.Contains(strings.ToLower(info.Family), strings.ToLower(familyFilter)) {
+			continue
+		}
+
+		font, err := fontManager.LoadFontSpec(info.Path)
+		if err != nil {
+			return fmt.Errorf("loading font: %w", err)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", info.Family, info.Style, info.Weight, coverage(font, text), info.Path)
+	}
+
+	for _, name := range watermark.BuiltinFontNames() {
+		path := watermark.BuiltinPrefix + name
+		font, err := fontManager.LoadFontSpec(path)
+		if err != nil {
+			return fmt.Errorf("loading font: %w", err)
+		}
+		info := watermark.DescribeFont(font, path)
+		if familyFilter != "" && !strings.Contains(strings.ToLower(info.Family), strings.ToLower(familyFilter)) {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", info.Family, info.Style, info.Weight, coverage(font, text), path)
+	}
+
+	return w.Flush()
+}
+
+// coverage formats how many distinct characters of text the font can render
+func coverage(font *opentype.Font, text string) string {
+	total := 0
+	seen := make(map[rune]bool)
+	for _, r := range text {
+		if !seen[r] && !strings.ContainsRune(" \t\n", r) {
+			seen[r] = true
+			total++
+		}
+	}
+
+	missing := watermark.MissingRunes(font, text)
+	if len(missing) == 0 {
+		return fmt.Sprintf("%d/%d", total, total)
+	}
+	return fmt.Sprintf("%d/%d (missing %q)", total-len(missing), total, string(missing))
+}
@@ -3,8 +3,8 @@ package cmd
 import (
 	"fmt"
 
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 
 	"github.com/denysvitali/id-watermark/pkg/watermark"
 )
@@ -23,66 +23,58 @@ Example:
 func init() {
 	rootCmd.AddCommand(processCmd)
 
-	// Required flags
-	processCmd.Flags().StringP("company", "c", "", "company name for watermark (required)")
-	processCmd.MarkFlagRequired("company")
-
-	// Optional flags
-	processCmd.Flags().StringP("font", "f", "", "path to TTF font file")
-	processCmd.Flags().Float64P("size", "s", 0, "font size for watermark (10-200)")
+	processCmd.Flags().StringP("company", "c", "", "company name for watermark (required unless set in the config)")
+	processCmd.Flags().String("purpose", "", "what the document is shared for, shown in the watermark text")
+	processCmd.Flags().String("recipient", "", "who the document is shared with, shown in the watermark text")
+	processCmd.Flags().Bool("forensic-mark", false, "add an identifier unique to every output to the watermark text")
+	processCmd.Flags().StringP("font", "f", "", "path to TTF/OTF font file or collection face (file.ttc#2), family name such as \"DejaVu Sans:bold\", or builtin:<sans|sans-bold|serif|mono>")
+	processCmd.Flags().StringArray("fallback-font", nil, "font tried for characters the main font lacks, in the same forms as --font (repeatable)")
+	processCmd.Flags().StringP("size", "s", "", "font size for watermark: points (10-200), percent of the image diagonal (2%), percent of the width (2%w) or millimetres (5mm)")
 	processCmd.Flags().Uint8P("opacity", "o", 0, "watermark opacity (0-255)")
-	processCmd.Flags().Float64P("text-spacing", "x", 0, "horizontal spacing between watermarks")
-	processCmd.Flags().Float64P("line-spacing", "y", 0, "vertical spacing between watermark lines")
+	processCmd.Flags().StringP("text-spacing", "x", "", "horizontal spacing between watermarks, in the same units as --size")
+	processCmd.Flags().StringP("line-spacing", "y", "", "vertical spacing between watermark lines, in the same units as --size")
 	processCmd.Flags().IntP("quality", "q", 0, "JPEG output quality (1-100)")
-
-	// Bind flags to viper
-	viper.BindPFlag("company", processCmd.Flags().Lookup("company"))
-	viper.BindPFlag("font_path", processCmd.Flags().Lookup("font"))
-	viper.BindPFlag("font_size", processCmd.Flags().Lookup("size"))
-	viper.BindPFlag("opacity", processCmd.Flags().Lookup("opacity"))
-	viper.BindPFlag("text_spacing", processCmd.Flags().Lookup("text-spacing"))
-	viper.BindPFlag("line_spacing", processCmd.Flags().Lookup("line-spacing"))
-	viper.BindPFlag("quality", processCmd.Flags().Lookup("quality"))
+	processCmd.Flags().String("color", "", "watermark text color: #RRGGBB, #RRGGBBAA, a CSS color name or rgba(r, g, b, a); without alpha, --opacity applies")
+	processCmd.Flags().String("stroke-color", "", "color of an outline around the watermark text, in the same forms as --color")
+	processCmd.Flags().String("background-color", "", "color of a band behind each watermark line, in the same forms as --color")
+	processCmd.Flags().Bool("detect-document", false, "detect the document, correct its perspective and crop to it before watermarking; images without one are watermarked whole")
+	processCmd.Flags().Bool("debug-outline", false, "save a copy of the input with the detected document outline drawn on it")
+	processCmd.Flags().Int("max-dimension", 0, "downscale so the longest side is at most this many pixels")
+	processCmd.Flags().Float64("target-dpi", 0, "downscale so the resolution is at most this DPI (when the input DPI is known)")
+	processCmd.Flags().StringArray("redact", nil, "region to redact before watermarking as x,y,width,height[:fill|pixelate|blur] (repeatable)")
 }
 
 func runProcess(cmd *cobra.Command, args []string) error {
 	inputPath := args[0]
 	outputPath := args[1]
-	companyName := viper.GetString("company")
 
 	logger.WithField("input", inputPath).WithField("output", outputPath).Info("Processing single image")
 
-	// Create overrides map for any provided flags
-	overrides := make(map[string]interface{})
-
-	if cmd.Flags().Changed("size") {
-		overrides["font_size"] = viper.GetFloat64("font_size")
-	}
-	if cmd.Flags().Changed("opacity") {
-		overrides["opacity"] = viper.GetInt("opacity")
-	}
-	if cmd.Flags().Changed("text-spacing") {
-		overrides["text_spacing"] = viper.GetFloat64("text_spacing")
-	}
-	if cmd.Flags().Changed("line-spacing") {
-		overrides["line_spacing"] = viper.GetFloat64("line_spacing")
-	}
-	if cmd.Flags().Changed("quality") {
-		overrides["quality"] = viper.GetInt("quality")
-	}
-
 	// Create watermark config
-	config, err := configMgr.CreateWatermarkConfig(companyName, viper.GetString("font_path"), overrides)
+	config, err := configMgr.CreateWatermarkConfig(nil)
 	if err != nil {
 		return fmt.Errorf("creating watermark config: %w", err)
 	}
+	config.DebugOutline, _ = cmd.Flags().GetBool("debug-outline")
+
+	if err := watermark.ValidateConfig(config); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
 
 	// Create processor and process the image
 	processor := watermark.NewProcessor(config)
-	if err := processor.ProcessFile(inputPath, outputPath); err != nil {
+	result, err := processor.Process(cmd.Context(), inputPath, outputPath)
+	if err != nil {
 		return fmt.Errorf("processing image: %w", err)
 	}
 
-	logger.Info("Image processed successfully")
+	fields := logrus.Fields{
+		"original_size": result.OriginalSize,
+		"final_size":    result.FinalSize,
+	}
+	if result.Mark != "" {
+		fields["mark"] = result.Mark
+	}
+	logger.WithFields(fields).Info("Image processed successfully")
 	return nil
 }
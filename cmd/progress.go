@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/denysvitali/id-watermark/pkg/watermark"
+)
+
+// progressInterval limits how often the progress line is redrawn
+const progressInterval = 100 * time.Millisecond
+
+// progress shows a live progress line for a batch. It is also the output of
+// the logger while shown, so log lines are written above the progress line.
+type progress struct {
+	mu       sync.Mutex
+	out      io.Writer
+	start    time.Time
+	lastDraw time.Time
+	drawn    bool
+
+	total   int
+	done    int
+	failed  int
+	skipped int
+	bytes   int64
+}
+
+// newProgress creates a progress line written to out
+func newProgress(out io.Writer) *progress {
+	return &progress{out: out, start: time.Now()}
+}
+
+// isTerminal reports whether a file is a terminal rather than a pipe or file
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// update records a batch event and redraws the progress line
+func (p *progress) update(event watermark.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.total = event.Total
+	switch event.Type {
+	case watermark.EventFinished, watermark.EventFailed, watermark.EventSkipped:
+		p.done++
+		p.bytes += event.InputBytes
+		if event.Type == watermark.EventFailed {
+			p.failed++
+		} else if event.Type == watermark.EventSkipped {
+			p.skipped++
+		}
+	}
+
+	if time.Since(p.lastDraw) >= progressInterval || p.done == p.total {
+		p.draw()
+	}
+}
+
+// draw writes the progress line over the previous one
+func (p *progress) draw() {
+	elapsed := time.Since(p.start)
+	line := fmt.Sprintf("%d/%d files", p.done, p.total)
+	if p.skipped > 0 {
+		line += fmt.Sprintf(", %d unchanged", p.skipped)
+	}
+	if p.failed > 0 {
+		line += fmt.Sprintf(", %d failed", p.failed)
+	}
+
+	if seconds := elapsed.Seconds(); p.done > 0 && seconds > 0 {
+		rate := float64(p.done) / seconds
+		line += fmt.Sprintf(", %.1f files/s, %.1f MB/s", rate, float64(p.bytes)/seconds/1e6)
+		if p.done < p.total {
+			eta := time.Duration(float64(p.total-p.done) / rate * float64(time.Second))
+			line += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+		}
+	}
+
+	fmt.Fprintf(p.out, "\r\033[K%s", line)
+	p.drawn = true
+	p.lastDraw = time.Now()
+}
+
+// Write writes log output above the progress line
+func (p *progress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.drawn {
+		fmt.Fprint(p.out, "\r\033[K")
+	}
+	n, err := p.out.Write(b)
+	if p.drawn {
+		p.draw()
+	}
+	return n, err
+}
+
+// finish ends the progress line, so later output starts on a new line
+func (p *progress) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.drawn {
+		p.draw()
+		fmt.Fprintln(p.out)
+		p.drawn = false
+	}
+}
@@ -0,0 +1,332 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/denysvitali/id-watermark/pkg/watermark"
+)
+
+// reportFormats maps report file extensions to formats
+var reportFormats = map[string]string{
+	".json": "json",
+	".csv":  "csv",
+	".xml":  "junit",
+}
+
+// report is a batch report, with an entry for every file
+type report struct {
+	Generated time.Time     `json:"generated"`
+	Total     int           `json:"total"`
+	Success   int           `json:"success"`
+	Skipped   int           `json:"skipped"`
+	Canceled  int           `json:"canceled"`
+	Errors    int           `json:"errors"`
+	Files     []reportEntry `json:"files"`
+}
+
+// reportEntry describes a processed or failed file
+type reportEntry struct {
+	Input        string               `json:"input"`
+	Output       string               `json:"output"`
+	Status       string               `json:"status"`
+	ErrorClass   watermark.ErrorClass `json:"error_class,omitempty"`
+	Error        string               `json:"error,omitempty"`
+	DurationMS   float64              `json:"duration_ms"`
+	InputSHA256  string               `json:"input_sha256,omitempty"`
+	OutputSHA256 string               `json:"output_sha256,omitempty"`
+	InputFormat  string               `json:"input_format,omitempty"`
+	OutputFormat string               `json:"output_format,omitempty"`
+	Width        int                  `json:"width,omitempty"`
+	Height       int                  `json:"height,omitempty"`
+	OutputWidth  int                  `json:"output_width,omitempty"`
+	OutputHeight int                  `json:"output_height,omitempty"`
+	Mark         string               `json:"mark,omitempty"`
+	Params       *watermark.Params    `json:"params,omitempty"`
+	Overrides    []string             `json:"overrides,omitempty"`
+}
+
+// newReport creates a report from a batch result, with files sorted by path
+func newReport(result *watermark.BatchResult) *report {
+	r := &report{
+		Generated: time.Now(),
+		Total:     result.TotalCount,
+		Success:   result.SuccessCount,
+		Skipped:   result.SkippedCount,
+		Canceled:  result.CanceledCount,
+		Errors:    result.ErrorCount,
+		Files:     make([]reportEntry, 0, result.TotalCount),
+	}
+
+	for _, file := range result.Files {
+		params := file.Params
+		r.Files = append(r.Files, reportEntry{
+			Input:        file.InputPath,
+			Output:       file.OutputPath,
+			Status:       "ok",
+			DurationMS:   milliseconds(file.Duration),
+			InputSHA256:  file.InputHash,
+			OutputSHA256: file.OutputHash,
+			InputFormat:  file.InputFormat,
+			OutputFormat: file.OutputFormat,
+			Width:        file.OriginalSize.X,
+			Height:       file.OriginalSize.Y,
+			OutputWidth:  file.FinalSize.X,
+			OutputHeight: file.FinalSize.Y,
+			Mark:         file.Mark,
+			Params:       &params,
+			Overrides:    file.Overrides,
+		})
+	}
+
+	for _, batchErr := range result.Errors {
+		r.Files = append(r.Files, reportEntry{
+			Input:      batchErr.FilePath,
+			Output:     batchErr.OutputPath,
+			Status:     "failed",
+			ErrorClass: batchErr.Class,
+			Error:      batchErr.Error.Error(),
+			DurationMS: milliseconds(batchErr.Duration),
+			Overrides:  batchErr.Overrides,
+		})
+	}
+
+	for _, input := range result.Skipped {
+		r.Files = append(r.Files, reportEntry{Input: input, Status: "skipped"})
+	}
+
+	sort.SliceStable(r.Files, func(i, j int) bool {
+		if r.Files[i].Input != r.Files[j].Input {
+			return r.Files[i].Input < r.Files[j].Input
+		}
+		return r.Files[i].Output < r.Files[j].Output
+	})
+	return r
+}
+
+// milliseconds converts a duration to fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// reportWriter writes a report to a file created before the batch starts,
+// so a bad path or format is found before any file is processed
+type reportWriter struct {
+	path  string
+	write func(io.Writer, *report) error
+	file  *os.File
+}
+
+// newReportWriter resolves the format of a report and creates its file. The
+// format is json, csv or junit, or taken from the file extension when empty.
+func newReportWriter(path, format string) (*reportWriter, error) {
+	if format == "" {
+		format = reportFormats[strings.ToLower(filepath.Ext(path))]
+		if format == "" {
+			return nil, fmt.Errorf("cannot tell the report format from %s, use --report-format json, csv or junit", path)
+		}
+	}
+
+	w := &reportWriter{path: path}
+	switch format {
+	case "json":
+		w.write = writeJSONReport
+	case "csv":
+		w.write = writeCSVReport
+	case "junit":
+		w.write = writeJUnitReport
+	default:
+		return nil, fmt.Errorf("unsupported report format %q (expected json, csv or junit)", format)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("creating report: %w", err)
+	}
+	w.file = file
+	return w, nil
+}
+
+// writeReport writes the report and closes its file
+func (w *reportWriter) writeReport(r *report) error {
+	file := w.file
+	w.file = nil
+	defer file.Close()
+
+	if err := w.write(file, r); err != nil {
+		return fmt.Errorf("writing report: %w", err)
+	}
+	return file.Close()
+}
+
+// abort removes the report file when no report was written, such as when
+// the batch could not start
+func (w *reportWriter) abort() {
+	if w.file != nil {
+		w.file.Close()
+		os.Remove(w.path)
+	}
+}
+
+// writeJSONReport writes the report as an indented JSON document
+func writeJSONReport(w io.Writer, r *report) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// csvColumns are the columns of a CSV report
+var csvColumns = []string{
+	"input", "output", "status", "error_class", "error", "duration_ms",
+	"input_sha256", "output_sha256", "input_format", "output_format",
+	"width", "height", "output_width", "output_height", "mark",
+	"text", "font_size", "text_spacing", "line_spacing", "opacity",
+	"color", "stroke_color", "background_color", "quality", "redactions",
+	"overrides",
+}
+
+// writeCSVReport writes the report as CSV, one row per file
+func writeCSVReport(w io.Writer, r *report) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvColumns); err != nil {
+		return err
+	}
+
+	for _, entry := range r.Files {
+		// Failed files have no parameters
+		var params watermark.Params
+		opacity := ""
+		if entry.Params != nil {
+			params = *entry.Params
+			opacity = strconv.Itoa(int(params.Opacity))
+		}
+		record := []string{
+			entry.Input, entry.Output, entry.Status, string(entry.ErrorClass), entry.Error,
+			strconv.FormatFloat(entry.DurationMS, 'f', 1, 64),
+			entry.InputSHA256, entry.OutputSHA256, entry.InputFormat, entry.OutputFormat,
+			itoa(entry.Width), itoa(entry.Height), itoa(entry.OutputWidth), itoa(entry.OutputHeight), entry.Mark,
+			params.Text, params.FontSize, params.TextSpacing, params.LineSpacing, opacity,
+			params.Color, params.StrokeColor, params.BackgroundColor, itoa(params.Quality), itoa(params.Redactions),
+			strings.Join(entry.Overrides, ";"),
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// itoa formats an int, leaving zero values empty
+func itoa(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// junitTestSuites is the root element of a JUnit XML report
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+// junitTestSuite is the batch, as a JUnit test suite
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      string          `xml:"time,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+// junitTestCase is a file of the batch, as a JUnit test case
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+// junitFailure is the error of a failed file
+type junitFailure struct {
+	Type    string `xml:"type,attr"`
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitSkipped marks a file skipped as unchanged
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// writeJUnitReport writes the report as JUnit XML, with a test case per file,
+// so CI systems can show and gate on failures
+func writeJUnitReport(w io.Writer, r *report) error {
+	suite := junitTestSuite{
+		Name:      "id-watermark batch",
+		Tests:     len(r.Files),
+		Failures:  r.Errors,
+		Skipped:   r.Skipped,
+		Timestamp: r.Generated.Format(time.RFC3339),
+	}
+
+	var total float64
+	for _, entry := range r.Files {
+		total += entry.DurationMS
+		// An input may be listed more than once in a job manifest, so the
+		// output is part of the name
+		testCase := junitTestCase{
+			ClassName: "id-watermark.batch",
+			Name:      entry.Input,
+			Time:      seconds(entry.DurationMS),
+		}
+		if entry.Output != "" {
+			testCase.Name = fmt.Sprintf("%s -> %s", entry.Input, entry.Output)
+		}
+		switch entry.Status {
+		case "skipped":
+			testCase.Skipped = &junitSkipped{Message: "unchanged since the last run"}
+		case "failed":
+			testCase.Failure = &junitFailure{
+				Type:    string(entry.ErrorClass),
+				Message: entry.Error,
+				Text:    entry.Error,
+			}
+		default:
+			testCase.SystemOut = fmt.Sprintf("sha256: %s", entry.OutputSHA256)
+		}
+		suite.Cases = append(suite.Cases, testCase)
+	}
+	suite.Time = seconds(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// seconds formats milliseconds as seconds, as JUnit expects
+func seconds(ms float64) string {
+	return strconv.FormatFloat(ms/1000, 'f', 3, 64)
+}
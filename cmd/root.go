@@ -1,16 +1,45 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 
 	"github.com/denysvitali/id-watermark/internal/config"
 )
 
+// configFlags maps command line flags to the configuration keys they
+// override. Flags are applied for the running command only, so commands can
+// share flag names.
+var configFlags = map[string]string{
+	"log-level":        "log_level",
+	"company":          "company",
+	"font":             "font_path",
+	"fallback-font":    "fallback_fonts",
+	"size":             "font_size",
+	"opacity":          "opacity",
+	"text-spacing":     "text_spacing",
+	"line-spacing":     "line_spacing",
+	"quality":          "quality",
+	"purpose":          "purpose",
+	"recipient":        "recipient",
+	"forensic-mark":    "forensic_mark",
+	"color":            "watermark_color",
+	"stroke-color":     "stroke_color",
+	"background-color": "background_color",
+	"detect-document":  "detect_document",
+	"redact":           "redactions",
+	"max-dimension":    "max_dimension",
+	"target-dpi":       "target_dpi",
+	"workers":          "default_workers",
+	"memory-budget":    "memory_budget",
+}
+
 var (
 	cfgFile   string
 	configMgr *config.Manager
@@ -22,13 +51,30 @@ var (
 It's specifically designed for ID cards and sensitive documents to prevent
 unauthorized use by applying a repeating diagonal pattern of company name
 and timestamp across the entire image.`,
-		PersistentPreRun: initializeConfig,
+		PersistentPreRunE: initializeConfig,
 	}
 )
 
-// Execute executes the root command
+// Execute runs the root command. The first SIGINT or SIGTERM cancels the
+// context of the running command so it can stop cleanly; a second one exits
+// immediately.
 func Execute() error {
-	return rootCmd.Execute()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	go func() {
+		<-signals
+		// Restore the default behavior, so another signal exits
+		signal.Stop(signals)
+		logrus.StandardLogger().Warn("Interrupted, stopping after the files in progress (interrupt again to exit immediately)")
+		cancel()
+	}()
+
+	return rootCmd.ExecuteContext(ctx)
 }
 
 func init() {
@@ -38,10 +84,7 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.config/id-watermark/config.yaml)")
 	rootCmd.PersistentFlags().String("log-level", "info", "log level (debug, info, warn, error)")
 	rootCmd.PersistentFlags().Bool("verbose", false, "verbose output")
-
-	// Bind flags to viper
-	viper.BindPFlag("log_level", rootCmd.PersistentFlags().Lookup("log-level"))
-	viper.BindPFlag("verbose", rootCmd.PersistentFlags().Lookup("verbose"))
+	rootCmd.PersistentFlags().String("preset", "", "named profile from the config file's profiles section")
 }
 
 // initConfig reads in config file and ENV variables
@@ -51,22 +94,40 @@ func initConfig() {
 	if err := configMgr.LoadConfig(cfgFile); err != nil {
 		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
 	}
+
+	// A broken policy is reported here and stops watermarks from being created
+	if err := configMgr.LoadPolicy(config.DefaultPolicyPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
 }
 
-// initializeConfig initializes the logger and other components
-func initializeConfig(cmd *cobra.Command, args []string) {
-	// Initialize logger
-	logger = logrus.New()
+// initializeConfig resolves the configuration of the running command and
+// initializes the logger and other components
+func initializeConfig(cmd *cobra.Command, args []string) error {
+	// Apply the selected preset over the loaded config
+	if preset, _ := cmd.Flags().GetString("preset"); preset != "" {
+		if err := configMgr.ApplyPreset(preset); err != nil {
+			return err
+		}
+	}
+
+	// Flags given on the command line override everything else
+	if err := configMgr.ApplyFlags(cmd.Flags(), configFlags); err != nil {
+		return err
+	}
+
+	// Initialize logger, shared with the watermark package through the standard logger
+	logger = logrus.StandardLogger()
 
 	// Set log level
-	level, err := logrus.ParseLevel(viper.GetString("log_level"))
+	level, err := logrus.ParseLevel(configMgr.GetAppConfig().LogLevel)
 	if err != nil {
 		level = logrus.InfoLevel
 	}
 	logger.SetLevel(level)
 
 	// Set formatter
-	if viper.GetBool("verbose") {
+	if verbose, _ := cmd.Flags().GetBool("verbose"); verbose {
 		logger.SetFormatter(&logrus.TextFormatter{
 			FullTimestamp: true,
 			ForceColors:   true,
@@ -77,4 +138,6 @@ func initializeConfig(cmd *cobra.Command, args []string) {
 			DisableColors:    false,
 		})
 	}
+
+	return nil
 }
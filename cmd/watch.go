@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/denysvitali/id-watermark/pkg/watermark"
+)
+
+var watchCmd = &cobra.Command{
+	Use:   "watch [input-dir] [output-dir]",
+	Short: "Process images as they are added to a directory",
+	Long: `Watch a directory and add watermarks to the images saved to it, such as
+the inbox folder of a scanner, until interrupted.
+
+Images already in the directory are processed first. A new or changed image
+is processed once its size and modification time have not changed for the
+--settle time, so files still being written are left alone. Images are
+processed with the same settings, names and ` + watermark.StateFile + `
+as the batch command, and are moved to the --archive directory once done.
+With --archive, a new image saved with the name of an archived one is
+another document, so its output is numbered, as in scan_1.jpg. Images
+that fail are logged and left in place, and the watch goes on.
+
+Network mounts may not report every change, so use --poll to also rescan
+the directory at an interval.
+
+Examples:
+  id-watermark watch ./inbox ./watermarked --company "ACME Corp" --archive ./originals
+  id-watermark watch /mnt/scans ./out -r --poll 30s --settle 5s --output-format jpeg`,
+	Args:         cobra.ExactArgs(2),
+	RunE:         runWatch,
+	SilenceUsage: true,
+}
+
+func init() {
+	rootCmd.AddCommand(watchCmd)
+
+	watchCmd.Flags().StringP("company", "c", "", "company name for watermark (required unless set in the config)")
+	watchCmd.Flags().String("purpose", "", "what the document is shared for, shown in the watermark text")
+	watchCmd.Flags().String("recipient", "", "who the document is shared with, shown in the watermark text")
+	watchCmd.Flags().Bool("forensic-mark", false, "add an identifier unique to every output to the watermark text")
+	watchCmd.Flags().StringP("font", "f", "", "path to TTF/OTF font file or collection face (file.ttc#2), family name such as \"DejaVu Sans:bold\", or builtin:<sans|sans-bold|serif|mono>")
+	watchCmd.Flags().StringArray("fallback-font", nil, "font tried for characters the main font lacks, in the same forms as --font (repeatable)")
+	watchCmd.Flags().StringP("size", "s", "", "font size for watermark: points (10-200), percent of the image diagonal (2%), percent of the width (2%w) or millimetres (5mm)")
+	watchCmd.Flags().Uint8P("opacity", "o", 0, "watermark opacity (0-255)")
+	watchCmd.Flags().StringP("text-spacing", "x", "", "horizontal spacing between watermarks, in the same units as --size")
+	watchCmd.Flags().StringP("line-spacing", "y", "", "vertical spacing between watermark lines, in the same units as --size")
+	watchCmd.Flags().IntP("quality", "q", 0, "JPEG output quality (1-100)")
+	watchCmd.Flags().String("color", "", "watermark text color: #RRGGBB, #RRGGBBAA, a CSS color name or rgba(r, g, b, a); without alpha, --opacity applies")
+	watchCmd.Flags().String("stroke-color", "", "color of an outline around the watermark text, in the same forms as --color")
+	watchCmd.Flags().String("background-color", "", "color of a band behind each watermark line, in the same forms as --color")
+	watchCmd.Flags().Bool("detect-document", false, "detect the document, correct its perspective and crop to it before watermarking; images without one are watermarked whole")
+	watchCmd.Flags().Bool("debug-outline", false, "save a copy of the input with the detected document outline drawn on it")
+	watchCmd.Flags().Int("max-dimension", 0, "downscale so the longest side is at most this many pixels")
+	watchCmd.Flags().Float64("target-dpi", 0, "downscale so the resolution is at most this DPI (when the input DPI is known)")
+	watchCmd.Flags().StringArray("redact", nil, "region to redact before watermarking as x,y,width,height[:fill|pixelate|blur] (repeatable)")
+
+	// Watch-specific flags
+	watchCmd.Flags().IntP("workers", "w", 0, "number of parallel workers")
+	watchCmd.Flags().String("memory-budget", "", "memory the images processed at once may use, such as 4GB; large images wait for others to finish (default no limit)")
+	watchCmd.Flags().BoolP("recursive", "r", false, "process subdirectories recursively")
+	watchCmd.Flags().Bool("force", false, "reprocess files that are unchanged since the last run")
+	watchCmd.Flags().StringArray("include", nil, "only process files matching this glob, such as '**/*.jpg' or 'id_*' (repeatable)")
+	watchCmd.Flags().StringArray("exclude", nil, "skip files and directories matching this glob, such as '*_thumb.jpg' or .git (repeatable)")
+	watchCmd.Flags().Int("max-depth", 0, "with --recursive, search at most this many directory levels, where 1 is the input directory only")
+	watchCmd.Flags().Bool("follow-symlinks", false, "follow symlinks to files and directories instead of skipping them")
+	watchCmd.Flags().String("name-template", watermark.DefaultNameTemplate, "name of every output, with the placeholders {stem}, {ext}, {date}, {company} and {hash8}")
+	watchCmd.Flags().String("layout", string(watermark.LayoutMirror), "arrangement of the outputs: mirror the input tree, or flatten into the output directory")
+	watchCmd.Flags().String("output-format", "", "convert every output to this format: jpeg or png (default the format of the input)")
+	watchCmd.Flags().String("archive", "", "move the originals of processed images to this directory")
+	watchCmd.Flags().Duration("settle", watermark.DefaultSettle, "how long an image must stay unchanged before it is processed")
+	watchCmd.Flags().Duration("poll", 0, "also rescan the input directory at this interval, for network mounts (default only at the start)")
+}
+
+func runWatch(cmd *cobra.Command, args []string) error {
+	inputDir := args[0]
+	outputDir := args[1]
+
+	debugOutline, _ := cmd.Flags().GetBool("debug-outline")
+	recursive, _ := cmd.Flags().GetBool("recursive")
+	force, _ := cmd.Flags().GetBool("force")
+	include, _ := cmd.Flags().GetStringArray("include")
+	exclude, _ := cmd.Flags().GetStringArray("exclude")
+	maxDepth, _ := cmd.Flags().GetInt("max-depth")
+	followSymlinks, _ := cmd.Flags().GetBool("follow-symlinks")
+	nameTemplate, _ := cmd.Flags().GetString("name-template")
+	layout, _ := cmd.Flags().GetString("layout")
+	outputFormat, _ := cmd.Flags().GetString("output-format")
+	archiveDir, _ := cmd.Flags().GetString("archive")
+	settle, _ := cmd.Flags().GetDuration("settle")
+	poll, _ := cmd.Flags().GetDuration("poll")
+
+	if maxDepth < 0 {
+		return fmt.Errorf("--max-depth must not be negative")
+	}
+	if maxDepth > 0 && !recursive {
+		return fmt.Errorf("--max-depth requires --recursive")
+	}
+	if settle <= 0 || poll < 0 {
+		return fmt.Errorf("--settle must be positive and --poll must not be negative")
+	}
+
+	memoryBudget, err := watermark.ParseByteSize(configMgr.GetAppConfig().MemoryBudget)
+	if err != nil {
+		return fmt.Errorf("invalid memory budget: %w", err)
+	}
+
+	// Create watermark config
+	config, err := configMgr.CreateWatermarkConfig(nil)
+	if err != nil {
+		return fmt.Errorf("creating watermark config: %w", err)
+	}
+	config.DebugOutline = debugOutline
+
+	batchProcessor, err := watermark.NewBatchProcessor(config, &watermark.BatchOptions{
+		Workers:        configMgr.GetAppConfig().DefaultWorkers,
+		MemoryBudget:   memoryBudget,
+		Recursive:      recursive,
+		Force:          force,
+		Include:        include,
+		Exclude:        exclude,
+		MaxDepth:       maxDepth,
+		FollowSymlinks: followSymlinks,
+		NameTemplate:   nameTemplate,
+		Layout:         watermark.Layout(layout),
+		Format:         outputFormat,
+		Logger:         logger,
+		DirConfig:      dirWatermarkConfig(debugOutline),
+	})
+	if err != nil {
+		return fmt.Errorf("creating batch processor: %w", err)
+	}
+
+	fields := logrus.Fields{
+		"input_dir":  inputDir,
+		"output_dir": outputDir,
+		"settle":     settle.String(),
+	}
+	if archiveDir != "" {
+		fields["archive"] = archiveDir
+	}
+	logger.WithFields(fields).Info("Watching for new images")
+
+	err = batchProcessor.Watch(cmd.Context(), inputDir, outputDir, watermark.WatchOptions{
+		Settle:     settle,
+		Poll:       poll,
+		ArchiveDir: archiveDir,
+	})
+	if err != nil {
+		return fmt.Errorf("watching directory: %w", err)
+	}
+
+	logger.Info("Stopped watching")
+	return nil
+}
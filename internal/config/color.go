@@ -0,0 +1,183 @@
+package config
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"github.com/denysvitali/id-watermark/pkg/watermark"
+)
+
+// ColorSpec is a color in any form accepted by watermark.ParseColor. An
+// empty ColorSpec means the element is not drawn.
+type ColorSpec string
+
+// defaultWatermarkColor is the gray used when no watermark color is configured
+const defaultWatermarkColor = "rgb(150, 150, 150)"
+
+// legacyColor is the older {r, g, b, a} form of a color, used to validate it
+type legacyColor struct {
+	R uint8 `mapstructure:"r"`
+	G uint8 `mapstructure:"g"`
+	B uint8 `mapstructure:"b"`
+	A uint8 `mapstructure:"a"`
+}
+
+// legacyChannels are the keys of the older {r, g, b, a} form of a color.
+// Color channels left out keep the value of the default gray, and colors
+// without alpha are drawn with the opacity.
+var legacyChannels = []string{"r", "g", "b", "a"}
+
+// colorSpecHook lets colors be given in the older {r, g, b, a} mapping form
+func colorSpecHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != reflect.TypeOf(ColorSpec("")) {
+		return data, nil
+	}
+	return colorSpec(data)
+}
+
+// colorSpec converts a color setting, a string or an {r, g, b, a} mapping, to a string
+func colorSpec(value interface{}) (string, error) {
+	var channels map[string]interface{}
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case ColorSpec:
+		return string(v), nil
+	case map[string]interface{}:
+		channels = v
+	case map[interface{}]interface{}:
+		channels = make(map[string]interface{}, len(v))
+		for key, channel := range v {
+			channels[fmt.Sprint(key)] = channel
+		}
+	default:
+		return "", fmt.Errorf("invalid color %v (expected a string such as #RRGGBB or an r, g, b, a mapping)", value)
+	}
+
+	c := color.NRGBA{R: 150, G: 150, B: 150, A: 0xff}
+	hasAlpha := false
+	for key, channel := range channels {
+		index := channelIndex(key)
+		if index < 0 {
+			return "", fmt.Errorf("invalid color channel %q (expected r, g, b or a)", key)
+		}
+
+		n, err := strconv.Atoi(fmt.Sprint(channel))
+		if err != nil || n < 0 || n > 255 {
+			return "", fmt.Errorf("invalid color channel %s: %v (expected 0-255)", key, channel)
+		}
+		*colorChannels(&c)[index] = uint8(n)
+		hasAlpha = hasAlpha || index == 3
+	}
+
+	return formatColor(c, hasAlpha, false), nil
+}
+
+// colorChannels returns pointers to the channels of a color, in the order of legacyChannels
+func colorChannels(c *color.NRGBA) []*uint8 {
+	return []*uint8{&c.R, &c.G, &c.B, &c.A}
+}
+
+// formatColor formats a color in a form accepted by watermark.ParseColor,
+// as hex digits or with rgb() and rgba()
+func formatColor(c color.NRGBA, hasAlpha, hex bool) string {
+	switch {
+	case hex && hasAlpha:
+		return fmt.Sprintf("#%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+	case hex:
+		return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+	case hasAlpha:
+		// Three decimals are enough for the alpha to parse back to the same byte
+		alpha := strconv.FormatFloat(math.Round(float64(c.A)/255*1000)/1000, 'f', -1, 64)
+		return fmt.Sprintf("rgba(%d, %d, %d, %s)", c.R, c.G, c.B, alpha)
+	default:
+		return fmt.Sprintf("rgb(%d, %d, %d)", c.R, c.G, c.B)
+	}
+}
+
+// colorChannelKey splits a key naming a channel of a color in the older
+// {r, g, b, a} form, such as "watermark_color.r", into the color key and
+// the channel
+func colorChannelKey(key string) (string, string, bool) {
+	i := strings.LastIndex(key, ".")
+	if i < 0 {
+		return "", "", false
+	}
+	t, _, err := lookupKey(key[:i])
+	if err != nil || t != reflect.TypeOf(ColorSpec("")) {
+		return "", "", false
+	}
+	return key[:i], strings.ToLower(key[i+1:]), true
+}
+
+// channelIndex returns the index of a channel in legacyChannels
+func channelIndex(channel string) int {
+	for i, name := range legacyChannels {
+		if strings.EqualFold(channel, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// colorChannel returns a channel of a color setting, and whether the color
+// has it. Only colors with an explicit alpha have the a channel.
+func colorChannel(value interface{}, channel string) (uint8, bool, error) {
+	spec, err := colorSpec(value)
+	if err != nil || strings.TrimSpace(spec) == "" {
+		return 0, false, err
+	}
+	c, hasAlpha, err := watermark.ParseColor(spec)
+	if err != nil {
+		return 0, false, err
+	}
+	index := channelIndex(channel)
+	if index == 3 && !hasAlpha {
+		return 0, false, nil
+	}
+	return *colorChannels(&c)[index], true, nil
+}
+
+// withChannel changes a channel of a color given as a string, keeping the
+// hex form when the color uses it
+func withChannel(spec, channel string, value uint8) (string, error) {
+	c, hasAlpha, err := watermark.ParseColor(spec)
+	if err != nil {
+		return "", err
+	}
+	index := channelIndex(channel)
+	*colorChannels(&c)[index] = value
+	return formatColor(c, hasAlpha || index == 3, strings.HasPrefix(strings.TrimSpace(spec), "#")), nil
+}
+
+// colorSetting parses a color setting. Colors without an explicit alpha are
+// drawn with the given opacity, and an empty setting gives a transparent color.
+func colorSetting(v *viper.Viper, key string, opacity uint8) (color.RGBA, error) {
+	spec, err := colorSpec(v.Get(key))
+	if err != nil {
+		return color.RGBA{}, err
+	}
+	if strings.TrimSpace(spec) == "" {
+		return color.RGBA{}, nil
+	}
+
+	c, hasAlpha, err := watermark.ParseColor(spec)
+	if err != nil {
+		return color.RGBA{}, err
+	}
+	if !hasAlpha {
+		c.A = opacity
+	}
+
+	// Premultiply, as color.RGBA expects, so translucent colors blend
+	// correctly instead of overflowing on light backgrounds
+	return color.RGBAModel.Convert(c).(color.RGBA), nil
+}
@@ -2,12 +2,18 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"image/color"
+	"image"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/spf13/viper"
 
 	"github.com/denysvitali/id-watermark/pkg/watermark"
@@ -15,33 +21,90 @@ import (
 
 // AppConfig represents the application configuration
 type AppConfig struct {
+	// Company name shown in the watermark text
+	Company string `mapstructure:"company"`
+
 	// Default values
-	FontPath    string  `mapstructure:"font_path"`
-	FontSize    float64 `mapstructure:"font_size"`
-	Opacity     uint8   `mapstructure:"opacity"`
-	TextSpacing float64 `mapstructure:"text_spacing"`
-	LineSpacing float64 `mapstructure:"line_spacing"`
-	Quality     int     `mapstructure:"quality"`
-	LogLevel    string  `mapstructure:"log_level"`
-
-	// Watermark color
-	WatermarkColor struct {
-		R uint8 `mapstructure:"r"`
-		G uint8 `mapstructure:"g"`
-		B uint8 `mapstructure:"b"`
-	} `mapstructure:"watermark_color"`
+	FontPath    string `mapstructure:"font_path"`
+	FontSize    string `mapstructure:"font_size"`
+	Opacity     uint8  `mapstructure:"opacity"`
+	TextSpacing string `mapstructure:"text_spacing"`
+	LineSpacing string `mapstructure:"line_spacing"`
+	Quality     int    `mapstructure:"quality"`
+	LogLevel    string `mapstructure:"log_level"`
+
+	// Watermark text with {company}, {date}, {purpose}, {recipient} and {mark} placeholders
+	TextTemplate string `mapstructure:"text_template"`
+
+	// What the document is shared for, shown in the watermark text
+	Purpose string `mapstructure:"purpose"`
+
+	// Who the document is shared with, shown in the watermark text
+	Recipient string `mapstructure:"recipient"`
+
+	// Add an identifier unique to every output to the watermark text
+	ForensicMark bool `mapstructure:"forensic_mark"`
+
+	// Pre-processing
+	DetectDocument bool              `mapstructure:"detect_document"`
+	Redactions     []RedactionConfig `mapstructure:"redactions"`
+	MaxDimension   int               `mapstructure:"max_dimension"`
+	TargetDPI      float64           `mapstructure:"target_dpi"`
+
+	// Colors of the watermark text, its outline and the band behind it
+	WatermarkColor  ColorSpec `mapstructure:"watermark_color"`
+	StrokeColor     ColorSpec `mapstructure:"stroke_color"`
+	BackgroundColor ColorSpec `mapstructure:"background_color"`
 
 	// System font paths
 	SystemFontPaths []string `mapstructure:"system_font_paths"`
 
+	// Additional directories scanned when fonts are given by family name
+	FontDirs []string `mapstructure:"font_dirs"`
+
+	// Fonts tried in order for characters the main font lacks
+	FallbackFonts []string `mapstructure:"fallback_fonts"`
+
 	// Batch processing
 	DefaultWorkers int `mapstructure:"default_workers"`
+	// Memory the images processed at once may use, such as 4GB (empty for no limit)
+	MemoryBudget string `mapstructure:"memory_budget"`
+
+	// Named presets, each overriding any of the settings above
+	Profiles map[string]map[string]interface{} `mapstructure:"profiles"`
 }
 
+// RedactionConfig describes a region to redact before watermarking
+type RedactionConfig struct {
+	X      int    `mapstructure:"x"`
+	Y      int    `mapstructure:"y"`
+	Width  int    `mapstructure:"width"`
+	Height int    `mapstructure:"height"`
+	Mode   string `mapstructure:"mode"`
+}
+
+// legacyDefaultFontPath is the font_path that config files were generated
+// with before the default became empty. It only ever worked through the
+// fallback to system fonts, so it still falls back when the file is missing.
+const legacyDefaultFontPath = "./DejaVuSans.ttf"
+
 // Manager handles configuration loading and management
 type Manager struct {
-	config *AppConfig
-	viper  *viper.Viper
+	config   *AppConfig
+	viper    *viper.Viper
+	preset   string
+	profile  map[string]interface{}
+	fileKeys map[string]bool
+
+	// flags maps keys set on the command line to the flag that set them
+	flags map[string]string
+
+	policy    *Policy
+	policyErr error
+
+	// fontManagers are the font managers of each set of font settings, so
+	// the font directories are scanned once rather than for every config
+	fontManagers map[string]*watermark.FontManager
 }
 
 // NewManager creates a new configuration manager
@@ -52,26 +115,48 @@ func NewManager() *Manager {
 	setDefaults(v)
 
 	return &Manager{
-		config: &AppConfig{},
-		viper:  v,
+		config:       &AppConfig{},
+		viper:        v,
+		fileKeys:     make(map[string]bool),
+		flags:        make(map[string]string),
+		fontManagers: make(map[string]*watermark.FontManager),
 	}
 }
 
 // setDefaults sets default configuration values
 func setDefaults(v *viper.Viper) {
-	v.SetDefault("font_path", "./DejaVuSans.ttf")
+	v.SetDefault("company", "")
+	v.SetDefault("font_path", "")
 	v.SetDefault("font_size", 40.0)
 	v.SetDefault("opacity", 40)
 	v.SetDefault("text_spacing", 30.0)
 	v.SetDefault("line_spacing", 30.0)
 	v.SetDefault("quality", 95)
 	v.SetDefault("log_level", "info")
+	v.SetDefault("text_template", watermark.DefaultTextTemplate)
+	v.SetDefault("purpose", "")
+	v.SetDefault("recipient", "")
+	v.SetDefault("forensic_mark", false)
 	v.SetDefault("default_workers", 4)
-
-	// Default watermark color (gray)
-	v.SetDefault("watermark_color.r", 150)
-	v.SetDefault("watermark_color.g", 150)
-	v.SetDefault("watermark_color.b", 150)
+	v.SetDefault("memory_budget", "")
+	v.SetDefault("detect_document", false)
+	v.SetDefault("max_dimension", 0)
+	v.SetDefault("target_dpi", 0.0)
+
+	// Default watermark color (gray), without outline or band
+	v.SetDefault("watermark_color", defaultWatermarkColor)
+	v.SetDefault("stroke_color", "")
+	v.SetDefault("background_color", "")
+
+	// Default fallback fonts for non-Latin scripts, skipped when not installed
+	v.SetDefault("fallback_fonts", []string{
+		"Noto Sans",
+		"Noto Sans CJK JP",
+		"Noto Sans Arabic",
+		"Noto Sans Hebrew",
+		"DejaVu Sans",
+		"builtin:sans",
+	})
 
 	// Default system font paths
 	v.SetDefault("system_font_paths", []string{
@@ -99,9 +184,17 @@ func (m *Manager) LoadConfig(configFile string) error {
 		m.viper.AddConfigPath("/etc/id-watermark")
 	}
 
-	// Environment variable support
-	m.viper.SetEnvPrefix("WATERMARK")
+	// Environment variable support. Every key is bound explicitly so that
+	// keys without a default, and nested keys like profiles.kyc.opacity, are
+	// picked up when unmarshaling too.
+	m.viper.SetEnvPrefix(envPrefix)
+	m.viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	m.viper.AutomaticEnv()
+	for _, key := range Keys() {
+		if err := m.viper.BindEnv(key); err != nil {
+			return fmt.Errorf("binding environment variable for %s: %w", key, err)
+		}
+	}
 
 	// Read config file if it exists
 	if err := m.viper.ReadInConfig(); err != nil {
@@ -111,62 +204,267 @@ func (m *Manager) LoadConfig(configFile string) error {
 		// Config file not found is OK, we'll use defaults
 	}
 
+	for _, key := range Keys() {
+		if m.viper.InConfig(key) {
+			m.fileKeys[key] = true
+		}
+	}
+
 	// Unmarshal into struct
-	if err := m.viper.Unmarshal(m.config); err != nil {
+	return m.unmarshal()
+}
+
+// unmarshal decodes the settings into the AppConfig
+func (m *Manager) unmarshal() error {
+	if err := decodeSettings(m.viper, m.config); err != nil {
 		return fmt.Errorf("unmarshaling config: %w", err)
 	}
+	return nil
+}
+
+// decodeSettings decodes settings into an AppConfig
+func decodeSettings(v *viper.Viper, config *AppConfig) error {
+	hook := mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		colorSpecHook,
+	)
+	return v.Unmarshal(config, viper.DecodeHook(hook))
+}
+
+// ApplyPreset layers a named profile from the config file over the file's
+// top-level settings. Environment variables and flags still take precedence,
+// giving the order defaults, file, preset, env, flags.
+func (m *Manager) ApplyPreset(name string) error {
+	profiles := m.viper.GetStringMap("profiles")
+	profile, ok := profiles[strings.ToLower(name)].(map[string]interface{})
+	if !ok {
+		available := make([]string, 0, len(profiles))
+		for profileName := range profiles {
+			available = append(available, profileName)
+		}
+		sort.Strings(available)
+		return fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(available, ", "))
+	}
 
+	if err := m.viper.MergeConfigMap(profile); err != nil {
+		return fmt.Errorf("applying preset %s: %w", name, err)
+	}
+
+	if err := m.unmarshal(); err != nil {
+		return err
+	}
+
+	m.preset = name
+	m.profile = profile
 	return nil
 }
 
+// ConfigFileUsed returns the path of the loaded config file, or an empty
+// string when only defaults and environment variables are in use
+func (m *Manager) ConfigFileUsed() string {
+	return m.viper.ConfigFileUsed()
+}
+
+// Preset returns the name of the applied preset, or an empty string
+func (m *Manager) Preset() string {
+	return m.preset
+}
+
 // GetAppConfig returns the loaded application configuration
 func (m *Manager) GetAppConfig() *AppConfig {
 	return m.config
 }
 
-// CreateWatermarkConfig creates a watermark configuration from app config and parameters
-func (m *Manager) CreateWatermarkConfig(companyName, fontPath string, overrides map[string]interface{}) (*watermark.Config, error) {
-	// Apply any overrides
-	for key, value := range overrides {
-		m.viper.Set(key, value)
+// CreateWatermarkConfig creates a watermark configuration from the
+// effective settings. Overrides, such as those of a directory config file,
+// are layered over the settings for this config only.
+func (m *Manager) CreateWatermarkConfig(overrides map[string]interface{}) (*watermark.Config, error) {
+	v, err := m.settingsWith(overrides)
+	if err != nil {
+		return nil, fmt.Errorf("applying overrides: %w", err)
 	}
 
-	// Use provided font path or fall back to config
-	if fontPath == "" {
-		fontPath = m.viper.GetString("font_path")
+	fontPath := v.GetString("font_path")
+	if fontPath == legacyDefaultFontPath {
+		if _, err := os.Stat(fontPath); err != nil {
+			fontPath = ""
+		}
 	}
 
 	// Load font
-	fontManager := watermark.NewFontManager()
-	fontManager.SetSystemFontPaths(m.viper.GetStringSlice("system_font_paths"))
+	fontManager := m.fontManager(v)
 
 	font, err := fontManager.LoadFont(fontPath)
 	if err != nil {
 		return nil, fmt.Errorf("loading font: %w", err)
 	}
 
+	// Sizes may be absolute or relative to each image
+	fontSize, err := watermark.ParseLength(v.GetString("font_size"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing font size: %w", err)
+	}
+	textSpacing, err := watermark.ParseLength(v.GetString("text_spacing"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing text spacing: %w", err)
+	}
+	lineSpacing, err := watermark.ParseLength(v.GetString("line_spacing"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing line spacing: %w", err)
+	}
+
+	redactions, err := redactions(v)
+	if err != nil {
+		return nil, fmt.Errorf("parsing redactions: %w", err)
+	}
+
+	opacity := uint8(v.GetInt("opacity"))
+	watermarkColor, err := colorSetting(v, "watermark_color", opacity)
+	if err != nil {
+		return nil, fmt.Errorf("parsing watermark color: %w", err)
+	}
+	strokeColor, err := colorSetting(v, "stroke_color", opacity)
+	if err != nil {
+		return nil, fmt.Errorf("parsing stroke color: %w", err)
+	}
+	backgroundColor, err := colorSetting(v, "background_color", opacity)
+	if err != nil {
+		return nil, fmt.Errorf("parsing background color: %w", err)
+	}
+
 	// Create watermark config
 	config := &watermark.Config{
-		CompanyName: companyName,
-		Timestamp:   time.Now(),
-		FontSize:    m.viper.GetFloat64("font_size"),
-		Opacity:     uint8(m.viper.GetInt("opacity")),
-		Angle:       0, // TODO: make configurable
-		Font:        font,
-		TextSpacing: m.viper.GetFloat64("text_spacing"),
-		LineSpacing: m.viper.GetFloat64("line_spacing"),
-		Quality:     m.viper.GetInt("quality"),
-		WatermarkColor: color.RGBA{
-			R: uint8(m.viper.GetInt("watermark_color.r")),
-			G: uint8(m.viper.GetInt("watermark_color.g")),
-			B: uint8(m.viper.GetInt("watermark_color.b")),
-			A: uint8(m.viper.GetInt("opacity")),
-		},
+		CompanyName:     v.GetString("company"),
+		Timestamp:       time.Now(),
+		TextTemplate:    v.GetString("text_template"),
+		FontSize:        fontSize,
+		Opacity:         opacity,
+		Angle:           0, // TODO: make configurable
+		Font:            font,
+		TextSpacing:     textSpacing,
+		LineSpacing:     lineSpacing,
+		Quality:         v.GetInt("quality"),
+		WatermarkColor:  watermarkColor,
+		StrokeColor:     strokeColor,
+		BackgroundColor: backgroundColor,
+		Purpose:         v.GetString("purpose"),
+		Recipient:       v.GetString("recipient"),
+		ForensicMark:    v.GetBool("forensic_mark"),
+		DetectDocument:  v.GetBool("detect_document"),
+		Redactions:      redactions,
+		MaxDimension:    v.GetInt("max_dimension"),
+		TargetDPI:       v.GetFloat64("target_dpi"),
+	}
+
+	// Only scan for fallback fonts when the main font lacks some glyphs
+	if len(watermark.MissingRunes(font, config.DisplayText())) > 0 {
+		config.FallbackFonts = fontManager.LoadFallbackFonts(v.GetStringSlice("fallback_fonts"))
+	}
+
+	// The policy is checked last, so no setting can weaken it
+	if err := m.enforcePolicy(config, overrides); err != nil {
+		return nil, err
+	}
+
+	if config.Fingerprint, err = m.fingerprint(v); err != nil {
+		return nil, err
 	}
 
 	return config, nil
 }
 
+// fingerprint hashes the settings and policy a watermark config is created
+// from. Settings are decoded first, so the same value given as a flag or in
+// a file gives the same fingerprint. Settings that do not change the output
+// are left out.
+func (m *Manager) fingerprint(v *viper.Viper) (string, error) {
+	var settings AppConfig
+	if err := decodeSettings(v, &settings); err != nil {
+		return "", fmt.Errorf("decoding settings: %w", err)
+	}
+	settings.LogLevel, settings.DefaultWorkers, settings.MemoryBudget, settings.Profiles = "", 0, "", nil
+
+	data, err := json.Marshal(struct {
+		Settings AppConfig
+		Policy   *Policy
+	}{settings, m.policy})
+	if err != nil {
+		return "", fmt.Errorf("hashing settings: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// settingsWith returns the effective settings with overrides layered over
+// them, leaving the settings of the manager unchanged
+func (m *Manager) settingsWith(overrides map[string]interface{}) (*viper.Viper, error) {
+	if len(overrides) == 0 {
+		return m.viper, nil
+	}
+
+	v := viper.New()
+	if err := v.MergeConfigMap(m.viper.AllSettings()); err != nil {
+		return nil, err
+	}
+	if err := v.MergeConfigMap(overrides); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// NewFontManager returns a font manager using the configured system font
+// paths and font directories. It is shared with the watermark configs, so
+// the fonts it scans are not scanned again.
+func (m *Manager) NewFontManager() *watermark.FontManager {
+	return m.fontManager(m.viper)
+}
+
+// fontManager returns the font manager of the given settings, creating it
+// the first time those font settings are used
+func (m *Manager) fontManager(v *viper.Viper) *watermark.FontManager {
+	systemFontPaths := v.GetStringSlice("system_font_paths")
+	fontDirs := append(watermark.DefaultFontDirs(), v.GetStringSlice("font_dirs")...)
+
+	key := strings.Join(systemFontPaths, "\x00") + "\x01" + strings.Join(fontDirs, "\x00")
+	if fontManager, ok := m.fontManagers[key]; ok {
+		return fontManager
+	}
+
+	fontManager := watermark.NewFontManager()
+	fontManager.SetSystemFontPaths(systemFontPaths)
+	fontManager.SetFontDirs(fontDirs)
+	m.fontManagers[key] = fontManager
+	return fontManager
+}
+
+// redactions returns the configured redaction regions
+func redactions(v *viper.Viper) ([]watermark.Redaction, error) {
+	var entries []RedactionConfig
+	if err := v.UnmarshalKey("redactions", &entries); err != nil {
+		return nil, err
+	}
+
+	redactions := make([]watermark.Redaction, 0, len(entries))
+	for _, entry := range entries {
+		mode := entry.Mode
+		if mode == "" {
+			mode = string(watermark.RedactFill)
+		}
+		redaction := watermark.Redaction{
+			Rect: image.Rect(entry.X, entry.Y, entry.X+entry.Width, entry.Y+entry.Height),
+			Mode: watermark.RedactionMode(mode),
+		}
+		if err := redaction.Validate(); err != nil {
+			return nil, err
+		}
+		redactions = append(redactions, redaction)
+	}
+
+	return redactions, nil
+}
+
 // SaveConfig saves the current configuration to a file
 func (m *Manager) SaveConfig(filename string) error {
 	// Create directory if it doesn't exist
@@ -197,6 +495,12 @@ func GenerateExampleConfig(filename string) error {
 	manager.viper.Set("text_spacing", 35.0)
 	manager.viper.Set("line_spacing", 35.0)
 	manager.viper.Set("quality", 90)
+	manager.viper.Set("profiles", map[string]interface{}{
+		"bank-kyc": map[string]interface{}{
+			"opacity":       80,
+			"text_template": "{company} - KYC only - {date}",
+		},
+	})
 
 	return manager.SaveConfig(filename)
 }
@@ -0,0 +1,30 @@
+package config
+
+import "testing"
+
+func TestFontManagerShared(t *testing.T) {
+	m := NewManager()
+
+	if m.NewFontManager() != m.NewFontManager() {
+		t.Error("NewFontManager() created a new font manager for the same settings")
+	}
+
+	same, err := m.settingsWith(map[string]interface{}{"opacity": 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.fontManager(same) != m.NewFontManager() {
+		t.Error("overrides without font settings got a new font manager")
+	}
+
+	other, err := m.settingsWith(map[string]interface{}{"font_dirs": []string{t.TempDir()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.fontManager(other) == m.NewFontManager() {
+		t.Error("overrides with other font directories share the font manager")
+	}
+	if m.fontManager(other) != m.fontManager(other) {
+		t.Error("the same font directories got a new font manager")
+	}
+}
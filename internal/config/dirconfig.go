@@ -0,0 +1,45 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadDirConfig reads directory config files, outermost first, and merges
+// them into overrides for CreateWatermarkConfig. Settings of nearer files
+// take precedence. The files are validated like the main config file, and
+// profiles can only be defined in the main config file.
+func LoadDirConfig(files []string) (map[string]interface{}, error) {
+	merged := viper.New()
+	for _, file := range files {
+		problems, err := ValidateFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if len(problems) > 0 {
+			return nil, fmt.Errorf("invalid directory config: %s", joinProblems(problems))
+		}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading directory config: %w", err)
+		}
+
+		var values map[string]interface{}
+		if err := yaml.Unmarshal(data, &values); err != nil {
+			return nil, fmt.Errorf("parsing directory config %s: %w", file, err)
+		}
+		if _, ok := values["profiles"]; ok {
+			return nil, fmt.Errorf("%s: profiles can only be defined in the main config file", file)
+		}
+
+		if err := merged.MergeConfigMap(values); err != nil {
+			return nil, fmt.Errorf("merging directory config %s: %w", file, err)
+		}
+	}
+
+	return merged.AllSettings(), nil
+}
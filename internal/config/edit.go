@@ -0,0 +1,352 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/denysvitali/id-watermark/pkg/watermark"
+)
+
+// ErrKeyNotSet is returned when a key has no value
+var ErrKeyNotSet = errors.New("key is not set")
+
+// lookupKey resolves a key, or a dotted key such as "profiles.kyc.opacity", to the type of the AppConfig field it refers to. It
+// also returns the key with list indexes and profile names removed, which is
+// used to look up value checks.
+func lookupKey(key string) (reflect.Type, string, error) {
+	parts := strings.Split(strings.ToLower(key), ".")
+	fields := fieldsByKey(reflect.TypeOf(AppConfig{}))
+
+	var t reflect.Type
+	name := ""
+	for i := 0; i < len(parts); i++ {
+		if t != nil {
+			switch {
+			case t == reflect.TypeOf(ColorSpec("")):
+				// Colors have the channels of the older {r, g, b, a} form
+				fields = fieldsByKey(reflect.TypeOf(legacyColor{}))
+			case t.Kind() == reflect.Struct:
+			case t.Kind() == reflect.Map:
+				// Profile names are free-form and followed by top-level settings
+				fields = fieldsByKey(reflect.TypeOf(AppConfig{}))
+				delete(fields, name)
+				t = reflect.TypeOf(AppConfig{})
+				name = ""
+				continue
+			default:
+				return nil, "", fmt.Errorf("invalid key %q: %s has no sub-keys", key, strings.Join(parts[:i], "."))
+			}
+		}
+
+		field, ok := fields[parts[i]]
+		if !ok {
+			message := fmt.Sprintf("unknown key %q", key)
+			if suggestion := suggestKey(parts[i], fields); suggestion != "" {
+				message += fmt.Sprintf(", did you mean %q?", strings.Join(append(parts[:i:i], suggestion), "."))
+			}
+			return nil, "", errors.New(message)
+		}
+
+		t = field.Type
+		name = joinKey(name, parts[i])
+		if t.Kind() == reflect.Struct {
+			fields = fieldsByKey(t)
+		}
+	}
+
+	return t, name, nil
+}
+
+// Get returns the effective value of a key, after defaults, the config
+// file, the preset and environment variables are applied
+func (m *Manager) Get(key string) (interface{}, error) {
+	if _, _, err := lookupKey(key); err != nil {
+		return nil, err
+	}
+
+	// Channels are read from the color in any of its forms
+	if colorKey, channel, ok := colorChannelKey(key); ok {
+		value, found, err := colorChannel(m.viper.Get(colorKey), channel)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", colorKey, err)
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: %w", key, ErrKeyNotSet)
+		}
+		return value, nil
+	}
+
+	if !m.viper.IsSet(key) {
+		return nil, fmt.Errorf("%s: %w", key, ErrKeyNotSet)
+	}
+
+	return m.viper.Get(key), nil
+}
+
+// SetValue sets a key in a config file, creating the file if needed. The
+// values are type-checked against AppConfig; list settings take one value
+// per element and redactions are given as "x,y,width,height[:mode]". The
+// file's comments and key order are kept, and so is the form of a color
+// whose channel is set.
+func SetValue(filename, key string, values []string) error {
+	t, name, err := lookupKey(key)
+	if err != nil {
+		return err
+	}
+
+	value, err := valueNode(t, key, values)
+	if err != nil {
+		return err
+	}
+
+	// Reuse the checks of config validate, so set accepts the same values
+	v := &validator{file: filename}
+	v.checkValue(value, t, key, name)
+	v.checkFonts()
+	if len(v.problems) > 0 {
+		return fmt.Errorf("invalid value for %s: %s", key, v.problems[0].Message)
+	}
+
+	document, err := readDocument(filename)
+	if err != nil {
+		return err
+	}
+
+	mapping := document.Content[0]
+	parts := strings.Split(strings.ToLower(key), ".")
+	_, channel, isChannel := colorChannelKey(key)
+	for i, part := range parts[:len(parts)-1] {
+		child := findKey(mapping, part)
+		if isChannel && i == len(parts)-2 && child != nil && child.Kind == yaml.ScalarNode {
+			if err := setStringChannel(child, channel, values[0]); err != nil {
+				return fmt.Errorf("cannot set %s: %w", key, err)
+			}
+			return writeDocument(filename, document)
+		}
+		if child == nil {
+			child = &yaml.Node{Kind: yaml.MappingNode}
+			mapping.Content = append(mapping.Content, scalarNode(part, "!!str"), child)
+		} else if child.Kind != yaml.MappingNode {
+			return fmt.Errorf("cannot set %s: %s is not a mapping in %s", key, part, filename)
+		}
+		mapping = child
+	}
+
+	last := parts[len(parts)-1]
+	if existing := findKey(mapping, last); existing != nil {
+		// Keep comments attached to the old value
+		value.HeadComment, value.LineComment, value.FootComment = existing.HeadComment, existing.LineComment, existing.FootComment
+		*existing = *value
+	} else {
+		mapping.Content = append(mapping.Content, scalarNode(last, "!!str"), value)
+	}
+
+	return writeDocument(filename, document)
+}
+
+// setStringChannel sets a channel of a color given as a string, so the color
+// keeps that form. An empty color becomes the {r, g, b, a} form.
+func setStringChannel(node *yaml.Node, channel, value string) error {
+	if strings.TrimSpace(node.Value) == "" {
+		node.Kind, node.Tag, node.Value, node.Style = yaml.MappingNode, "", "", 0
+		node.Content = []*yaml.Node{scalarNode(channel, "!!str"), scalarNode(value, "")}
+		return nil
+	}
+
+	// The value was checked to be between 0 and 255
+	n, _ := strconv.Atoi(value)
+	spec, err := withChannel(node.Value, channel, uint8(n))
+	if err != nil {
+		return err
+	}
+	node.Tag, node.Value, node.Style = "!!str", spec, 0
+	return nil
+}
+
+// UnsetValue removes a key from a config file. Sections left empty are removed as well.
+func UnsetValue(filename, key string) error {
+	if _, _, err := lookupKey(key); err != nil {
+		return err
+	}
+
+	document, err := readDocument(filename)
+	if err != nil {
+		return err
+	}
+
+	if !removeKey(document.Content[0], strings.Split(key, ".")) {
+		return fmt.Errorf("%s in %s: %w", key, filename, ErrKeyNotSet)
+	}
+
+	return writeDocument(filename, document)
+}
+
+// valueNode builds the YAML node for a value given on the command line
+func valueNode(t reflect.Type, key string, values []string) (*yaml.Node, error) {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return nil, fmt.Errorf("%s is a section, set its keys individually", key)
+
+	case reflect.Slice:
+		list := &yaml.Node{Kind: yaml.SequenceNode}
+		for _, value := range values {
+			if t.Elem().Kind() != reflect.Struct {
+				list.Content = append(list.Content, scalarNode(value, "!!str"))
+				continue
+			}
+
+			redaction, err := watermark.ParseRedaction(value)
+			if err != nil {
+				return nil, err
+			}
+			size := redaction.Rect.Size()
+			list.Content = append(list.Content, &yaml.Node{
+				Kind: yaml.MappingNode,
+				Content: []*yaml.Node{
+					scalarNode("x", "!!str"), scalarNode(strconv.Itoa(redaction.Rect.Min.X), "!!int"),
+					scalarNode("y", "!!str"), scalarNode(strconv.Itoa(redaction.Rect.Min.Y), "!!int"),
+					scalarNode("width", "!!str"), scalarNode(strconv.Itoa(size.X), "!!int"),
+					scalarNode("height", "!!str"), scalarNode(strconv.Itoa(size.Y), "!!int"),
+					scalarNode("mode", "!!str"), scalarNode(string(redaction.Mode), "!!str"),
+				},
+			})
+		}
+		return list, nil
+
+	default:
+		if len(values) != 1 {
+			return nil, fmt.Errorf("%s takes a single value, got %d", key, len(values))
+		}
+		// Strings are tagged so values like "40" or "yes" are quoted as needed,
+		// other types are resolved from the value and checked when decoding
+		tag := ""
+		if t.Kind() == reflect.String {
+			tag = "!!str"
+		}
+		return scalarNode(values[0], tag), nil
+	}
+}
+
+// scalarNode creates a scalar YAML node
+func scalarNode(value, tag string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value}
+}
+
+// findKey returns the value of a key in a mapping, matching keys case-insensitively like viper
+func findKey(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if strings.EqualFold(mapping.Content[i].Value, key) {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// removeKey removes a dotted key from a mapping and reports whether it was found
+func removeKey(mapping *yaml.Node, parts []string) bool {
+	if mapping.Kind != yaml.MappingNode {
+		return false
+	}
+
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if !strings.EqualFold(mapping.Content[i].Value, parts[0]) {
+			continue
+		}
+
+		if len(parts) > 1 {
+			child := mapping.Content[i+1]
+			if !removeKey(child, parts[1:]) {
+				return false
+			}
+			if len(child.Content) > 0 {
+				return true
+			}
+		}
+
+		mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+		return true
+	}
+
+	return false
+}
+
+// readDocument parses a YAML config file, returning an empty document when
+// the file does not exist yet
+func readDocument(filename string) (*yaml.Node, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml", "":
+	default:
+		return nil, fmt.Errorf("only YAML configuration files can be edited, got %s", filename)
+	}
+
+	document := &yaml.Node{Kind: yaml.DocumentNode}
+
+	data, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	if err := yaml.Unmarshal(data, document); err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", filename, err)
+	}
+
+	if len(document.Content) == 0 {
+		document.Kind = yaml.DocumentNode
+		document.Content = []*yaml.Node{{Kind: yaml.MappingNode}}
+	}
+	if document.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("config file %s does not contain a mapping", filename)
+	}
+
+	return document, nil
+}
+
+// writeDocument writes a YAML document back to its file, keeping the
+// indentation the file already uses
+func writeDocument(filename string, document *yaml.Node) error {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(detectIndent(document.Content[0]))
+	if err := encoder.Encode(document); err != nil {
+		return fmt.Errorf("encoding config: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("encoding config: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("creating config directory: %w", err)
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	if err := os.WriteFile(filename, buf.Bytes(), mode); err != nil {
+		return fmt.Errorf("writing config file: %w", err)
+	}
+
+	return nil
+}
+
+// detectIndent returns the indentation of the first nested mapping in the
+// document, or 2 when there is none
+func detectIndent(mapping *yaml.Node) int {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		key, value := mapping.Content[i], mapping.Content[i+1]
+		if value.Kind == yaml.MappingNode && len(value.Content) > 0 && value.Content[0].Line > key.Line {
+			if indent := value.Content[0].Column - key.Column; indent > 0 {
+				return indent
+			}
+		}
+	}
+	return 2
+}
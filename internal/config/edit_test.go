@@ -0,0 +1,122 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetValueColorChannel(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		key   string
+		value string
+		want  string
+	}{
+		{
+			name:  "mapping form is kept",
+			file:  "watermark_color:\n  r: 10\n  g: 20\n",
+			key:   "watermark_color.b",
+			value: "30",
+			want:  "watermark_color:\n  r: 10\n  g: 20\n  b: 30\n",
+		},
+		{
+			name:  "hex form is kept",
+			file:  "watermark_color: \"#c80000\" # red\n",
+			key:   "watermark_color.g",
+			value: "255",
+			want:  "watermark_color: '#c8ff00' # red\n",
+		},
+		{
+			name:  "alpha is added to a hex color",
+			file:  "watermark_color: \"#c80000\"\n",
+			key:   "watermark_color.a",
+			value: "128",
+			want:  "watermark_color: '#c8000080'\n",
+		},
+		{
+			name:  "named color becomes rgba",
+			file:  "stroke_color: red\n",
+			key:   "stroke_color.a",
+			value: "64",
+			want:  "stroke_color: rgba(255, 0, 0, 0.251)\n",
+		},
+		{
+			name:  "unset color uses the mapping form",
+			file:  "opacity: 40\n",
+			key:   "background_color.r",
+			value: "5",
+			want:  "opacity: 40\nbackground_color:\n  r: 5\n",
+		},
+		{
+			name:  "profile color",
+			file:  "profiles:\n  kyc:\n    watermark_color: rgb(1, 2, 3)\n",
+			key:   "profiles.kyc.watermark_color.r",
+			value: "9",
+			want:  "profiles:\n  kyc:\n    watermark_color: rgb(9, 2, 3)\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(filename, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := SetValue(filename, tt.key, []string{tt.value}); err != nil {
+				t.Fatalf("SetValue(%s, %s) failed: %v", tt.key, tt.value, err)
+			}
+
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("file after SetValue(%s, %s) =\n%s\nwant\n%s", tt.key, tt.value, data, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetValueColorChannelInvalid(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	for _, key := range []string{"watermark_color.x", "opacity.r"} {
+		if err := SetValue(filename, key, []string{"1"}); err == nil {
+			t.Errorf("SetValue(%s) succeeded, want an invalid key error", key)
+		}
+	}
+	if err := SetValue(filename, "watermark_color.r", []string{"300"}); err == nil {
+		t.Error("SetValue(watermark_color.r, 300) succeeded, want a range error")
+	}
+}
+
+func TestColorChannel(t *testing.T) {
+	tests := []struct {
+		value   interface{}
+		channel string
+		want    uint8
+		found   bool
+	}{
+		{"#c80000", "r", 200, true},
+		{"#c80000", "a", 0, false},
+		{"#c8000080", "a", 128, true},
+		{"rgb(150, 150, 150)", "g", 150, true},
+		{map[string]interface{}{"r": 10}, "r", 10, true},
+		{map[string]interface{}{"r": 10}, "b", 150, true},
+		{map[string]interface{}{"a": 64}, "a", 64, true},
+		{"", "r", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, found, err := colorChannel(tt.value, tt.channel)
+		if err != nil {
+			t.Errorf("colorChannel(%v, %s) failed: %v", tt.value, tt.channel, err)
+			continue
+		}
+		if got != tt.want || found != tt.found {
+			t.Errorf("colorChannel(%v, %s) = %d, %t, want %d, %t", tt.value, tt.channel, got, found, tt.want, tt.found)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package config
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ManifestJob is an image listed in a job manifest, with its own settings
+type ManifestJob struct {
+	// Line is the line of the job in the manifest
+	Line   int
+	Input  string
+	Output string
+	// Overrides are the settings of the job, for CreateWatermarkConfig
+	Overrides map[string]interface{}
+	// Err is set when the entry of the job is invalid
+	Err error
+}
+
+// manifestPaths are the keys of a manifest entry that are not settings
+var manifestPaths = []string{"input", "output"}
+
+// runKeys are settings that apply to a whole run and cannot be set per job
+var runKeys = []string{"profiles", "log_level", "default_workers", "memory_budget"}
+
+// manifestEntry is an entry of a manifest as a mapping, so it can be checked
+// like a config file, with problems found while converting it
+type manifestEntry struct {
+	node     *yaml.Node
+	problems []Problem
+}
+
+// LoadManifest reads a job manifest: a CSV file with a header row, or a JSON
+// list of objects. Every job has an input and an output path, relative to
+// the working directory. Other columns or keys are settings such as company,
+// purpose, recipient or opacity, checked like those of the config file.
+// Empty CSV cells leave a setting unchanged, and list settings take values
+// separated by ";". Invalid entries are returned with Err set, so the other
+// jobs can still be processed. An entry with the same output as an earlier
+// one is invalid, as both would write the same file at once.
+func LoadManifest(filename string) ([]ManifestJob, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+
+	fields := fieldsByKey(reflect.TypeOf(AppConfig{}))
+	for _, key := range runKeys {
+		delete(fields, key)
+	}
+	for _, key := range manifestPaths {
+		fields[key] = reflect.StructField{Name: key, Type: reflect.TypeOf("")}
+	}
+
+	var entries []manifestEntry
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		entries, err = csvEntries(filename, data, fields)
+	case ".json":
+		entries, err = jsonEntries(data)
+	default:
+		return nil, fmt.Errorf("unsupported manifest %s (expected a .csv or .json file)", filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing manifest %s: %w", filename, err)
+	}
+
+	jobs := make([]ManifestJob, 0, len(entries))
+	outputs := make(map[string]int, len(entries))
+	for _, entry := range entries {
+		job := manifestJob(filename, entry, fields)
+		if job.Output != "" {
+			output := filepath.Clean(job.Output)
+			if line, ok := outputs[output]; ok && job.Err == nil {
+				job.Err = errors.New(Problem{
+					File:    filename,
+					Line:    entry.node.Line,
+					Column:  entry.node.Column,
+					Key:     "output",
+					Message: fmt.Sprintf("%s is already the output of line %d", job.Output, line),
+				}.String())
+			} else if !ok {
+				outputs[output] = entry.node.Line
+			}
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// manifestJob checks and decodes an entry of a manifest
+func manifestJob(filename string, e manifestEntry, fields map[string]reflect.StructField) ManifestJob {
+	entry := e.node
+	job := ManifestJob{Line: entry.Line}
+
+	v := &validator{file: filename, problems: e.problems}
+	v.checkFields(entry, fields, "", "")
+	v.checkFonts()
+
+	var values map[string]interface{}
+	if entry.Kind == yaml.MappingNode {
+		if err := entry.Decode(&values); err != nil && len(v.problems) == 0 {
+			v.report(entry, "", "%v", err)
+		}
+	}
+
+	job.Overrides = make(map[string]interface{}, len(values))
+	for key, value := range values {
+		job.Overrides[strings.ToLower(key)] = value
+	}
+	job.Input, _ = job.Overrides["input"].(string)
+	job.Output, _ = job.Overrides["output"].(string)
+	for _, key := range manifestPaths {
+		delete(job.Overrides, key)
+	}
+
+	if entry.Kind == yaml.MappingNode && (job.Input == "" || job.Output == "") {
+		v.report(entry, "", "input and output are required")
+	}
+	if len(v.problems) > 0 {
+		job.Err = errors.New(joinProblems(v.problems))
+	}
+
+	return job
+}
+
+// csvEntries converts the rows of a CSV manifest to mappings, so they can be
+// checked like config files. The header row names the setting of every column.
+func csvEntries(filename string, data []byte, fields map[string]reflect.StructField) ([]manifestEntry, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	seen := make(map[string]bool, len(header))
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		header[i] = column
+		if seen[column] {
+			return nil, fmt.Errorf("duplicate column %q", column)
+		}
+		seen[column] = true
+
+		if _, ok := fields[column]; !ok {
+			message := fmt.Sprintf("unknown column %q", column)
+			if suggestion := suggestKey(column, fields); suggestion != "" {
+				message += fmt.Sprintf(", did you mean %q?", suggestion)
+			}
+			return nil, errors.New(message)
+		}
+	}
+
+	var entries []manifestEntry
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		entry := manifestEntry{node: &yaml.Node{Kind: yaml.MappingNode, Line: line, Column: 1}}
+		for i, cell := range record {
+			cell = strings.TrimSpace(cell)
+			if cell == "" {
+				continue
+			}
+
+			key := header[i]
+			t := fields[key].Type
+			values := []string{cell}
+			if t.Kind() == reflect.Slice {
+				values = strings.Split(cell, ";")
+				for j := range values {
+					values[j] = strings.TrimSpace(values[j])
+				}
+			}
+
+			_, column := reader.FieldPos(i)
+			value, err := valueNode(t, key, values)
+			if err != nil {
+				entry.problems = append(entry.problems, Problem{File: filename, Line: line, Column: column, Key: key, Message: err.Error()})
+				continue
+			}
+			keyNode := scalarNode(key, "!!str")
+			setPosition(keyNode, line, column)
+			setPosition(value, line, column)
+			entry.node.Content = append(entry.node.Content, keyNode, value)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// jsonEntries returns the entries of a JSON manifest, a list of objects
+func jsonEntries(data []byte) ([]manifestEntry, error) {
+	// JSON is valid YAML, and parsing it as YAML keeps line numbers
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	if len(document.Content) == 0 {
+		return nil, nil
+	}
+
+	list := document.Content[0]
+	if list.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("expected a list of jobs, got %s", describeNode(list))
+	}
+	entries := make([]manifestEntry, 0, len(list.Content))
+	for _, node := range list.Content {
+		entries = append(entries, manifestEntry{node: node})
+	}
+	return entries, nil
+}
+
+// setPosition sets the position of a node and its children
+func setPosition(node *yaml.Node, line, column int) {
+	node.Line, node.Column = line, column
+	for _, child := range node.Content {
+		setPosition(child, line, column)
+	}
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadManifestDuplicateOutputs(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		manifest string
+		// errs are the expected errors of the jobs, "" for none
+		errs []string
+	}{
+		{
+			name:     "csv",
+			file:     "jobs.csv",
+			manifest: "input,output\na.png,out/a.png\nb.png,out/b.png\nc.png,out/./a.png\n",
+			errs:     []string{"", "", "out/./a.png is already the output of line 2"},
+		},
+		{
+			name: "json",
+			file: "jobs.json",
+			manifest: `[
+  {"input": "a.png", "output": "out/a.png"},
+  {"input": "b.png", "output": "out/a.png"},
+  {"input": "c.png", "output": "out/a.png"}
+]`,
+			errs: []string{"", "out/a.png is already the output of line 2", "out/a.png is already the output of line 2"},
+		},
+		{
+			name:     "distinct outputs",
+			file:     "jobs.csv",
+			manifest: "input,output\na.png,out/a.png\na.png,out/a.jpg\n",
+			errs:     []string{"", ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.manifest), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			jobs, err := LoadManifest(path)
+			if err != nil {
+				t.Fatalf("LoadManifest() error = %v", err)
+			}
+			if len(jobs) != len(tt.errs) {
+				t.Fatalf("LoadManifest() returned %d jobs, want %d", len(jobs), len(tt.errs))
+			}
+			for i, job := range jobs {
+				switch {
+				case tt.errs[i] == "" && job.Err != nil:
+					t.Errorf("job %d error = %v, want none", i, job.Err)
+				case tt.errs[i] != "" && (job.Err == nil || !strings.Contains(job.Err.Error(), tt.errs[i])):
+					t.Errorf("job %d error = %v, want %q", i, job.Err, tt.errs[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/denysvitali/id-watermark/pkg/watermark"
+)
+
+// DefaultPolicyPath is the system policy file, managed by administrators
+const DefaultPolicyPath = "/etc/id-watermark/policy.yaml"
+
+// Policy holds organisation-wide limits that user settings, presets,
+// environment variables and flags cannot weaken
+type Policy struct {
+	// MinOpacity is the lowest allowed opacity, including color alpha
+	MinOpacity int `yaml:"min_opacity" json:"min_opacity,omitempty"`
+	// MinDensity is the smallest fraction of the image the watermark text must cover
+	MinDensity float64 `yaml:"min_density" json:"min_density,omitempty"`
+	// RequirePurpose requires a purpose to be given for every watermark
+	RequirePurpose bool `yaml:"require_purpose" json:"require_purpose,omitempty"`
+	// RequireForensicMark adds a forensic mark to every output
+	RequireForensicMark bool `yaml:"require_forensic_mark" json:"require_forensic_mark,omitempty"`
+
+	// Path is the file the policy was loaded from
+	Path string `yaml:"-" json:"path"`
+}
+
+// LoadPolicy reads a policy file. A missing file means there is no policy
+// and nil is returned. Unknown keys are rejected, so a misspelled limit is
+// not silently ignored.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading policy file: %w", err)
+	}
+
+	policy := &Policy{Path: path}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(policy); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parsing policy file %s: %w", path, err)
+	}
+
+	if policy.MinOpacity < 0 || policy.MinOpacity > 255 {
+		return nil, fmt.Errorf("policy file %s: min_opacity must be between 0 and 255, got: %d", path, policy.MinOpacity)
+	}
+	if policy.MinDensity < 0 || policy.MinDensity > 1 {
+		return nil, fmt.Errorf("policy file %s: min_density must be between 0 and 1, got: %g", path, policy.MinDensity)
+	}
+
+	return policy, nil
+}
+
+// Constraints describes the active limits of the policy
+func (p *Policy) Constraints() []string {
+	var constraints []string
+	if p.MinOpacity > 0 {
+		constraints = append(constraints, fmt.Sprintf("opacity must be at least %d", p.MinOpacity))
+	}
+	if p.MinDensity > 0 {
+		constraints = append(constraints, fmt.Sprintf("watermark density must be at least %.2f", p.MinDensity))
+	}
+	if p.RequirePurpose {
+		constraints = append(constraints, "a purpose is required")
+	}
+	if p.RequireForensicMark {
+		constraints = append(constraints, "a forensic mark is added to every output")
+	}
+	return constraints
+}
+
+// LoadPolicy loads the policy enforced by CreateWatermarkConfig. When the
+// policy cannot be loaded, watermark configs cannot be created either, so a
+// broken policy file never results in unrestricted watermarks.
+func (m *Manager) LoadPolicy(path string) error {
+	m.policy, m.policyErr = LoadPolicy(path)
+	return m.policyErr
+}
+
+// Policy returns the loaded policy, or nil when there is none
+func (m *Manager) Policy() *Policy {
+	return m.policy
+}
+
+// enforcePolicy checks a watermark config against the policy, after all
+// overrides are applied, and turns on the forensic mark when required
+func (m *Manager) enforcePolicy(config *watermark.Config, overrides map[string]interface{}) error {
+	if m.policyErr != nil {
+		return fmt.Errorf("loading policy: %w", m.policyErr)
+	}
+
+	policy := m.policy
+	if policy == nil {
+		return nil
+	}
+
+	if int(config.Opacity) < policy.MinOpacity {
+		return fmt.Errorf("opacity %d %s is below the minimum of %d required by policy %s",
+			config.Opacity, m.describeSource(overrides, "opacity"), policy.MinOpacity, policy.Path)
+	}
+	if int(config.WatermarkColor.A) < policy.MinOpacity {
+		return fmt.Errorf("watermark color alpha %d %s is below the minimum opacity of %d required by policy %s",
+			config.WatermarkColor.A, m.describeSource(overrides, "watermark_color"), policy.MinOpacity, policy.Path)
+	}
+
+	if policy.RequirePurpose && strings.TrimSpace(config.Purpose) == "" {
+		return fmt.Errorf("a purpose is required by policy %s, set it with --purpose or the purpose setting", policy.Path)
+	}
+
+	if policy.RequireForensicMark {
+		_, overridden := overrides["forensic_mark"]
+		if !config.ForensicMark && (overridden || m.Source("forensic_mark") != SourceDefault) {
+			return fmt.Errorf("forensic mark cannot be disabled %s, it is required by policy %s",
+				m.describeSource(overrides, "forensic_mark"), policy.Path)
+		}
+		config.ForensicMark = true
+	}
+
+	if policy.MinDensity > 0 {
+		config.MinDensity = max(config.MinDensity, policy.MinDensity)
+		if density, ok := config.Density(); ok && density < policy.MinDensity {
+			return fmt.Errorf("watermark density %.2f (font size %s %s, text spacing %s %s, line spacing %s %s) is below the minimum of %.2f required by policy %s",
+				density,
+				config.FontSize, m.describeSource(overrides, "font_size"),
+				config.TextSpacing, m.describeSource(overrides, "text_spacing"),
+				config.LineSpacing, m.describeSource(overrides, "line_spacing"),
+				policy.MinDensity, policy.Path)
+		}
+	}
+
+	return nil
+}
+
+// describeSource describes where the value of a key comes from for error messages
+func (m *Manager) describeSource(overrides map[string]interface{}, key string) string {
+	if _, ok := overrides[key]; ok {
+		return "(set by override)"
+	}
+
+	switch m.Source(key) {
+	case SourceFlag:
+		return fmt.Sprintf("(set by --%s)", m.flags[key])
+	case SourceEnv:
+		return fmt.Sprintf("(set by %s)", EnvVar(key))
+	case SourcePreset:
+		return fmt.Sprintf("(set by preset %s)", m.preset)
+	case SourceFile:
+		return fmt.Sprintf("(set in %s)", m.ConfigFileUsed())
+	default:
+		return "(default)"
+	}
+}
@@ -0,0 +1,203 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/denysvitali/id-watermark/pkg/watermark"
+)
+
+// Source is where the effective value of a setting comes from
+type Source string
+
+const (
+	// SourceDefault is a built-in default value
+	SourceDefault Source = "default"
+	// SourceFile is a value from the config file
+	SourceFile Source = "file"
+	// SourcePreset is a value from the applied preset
+	SourcePreset Source = "preset"
+	// SourceEnv is a value from a WATERMARK_* environment variable
+	SourceEnv Source = "env"
+	// SourceFlag is a value from a command line flag
+	SourceFlag Source = "flag"
+)
+
+// envPrefix is the prefix of environment variables overriding settings
+const envPrefix = "WATERMARK"
+
+// Setting is the effective value of a configuration key and its source
+type Setting struct {
+	Key    string      `json:"key"`
+	Value  interface{} `json:"value"`
+	Source Source      `json:"source"`
+	EnvVar string      `json:"env_var,omitempty"`
+}
+
+// Keys returns every configuration key in the order of AppConfig, with
+// nested keys expanded. Profiles are not included.
+func Keys() []string {
+	return leafKeys(reflect.TypeOf(AppConfig{}), "")
+}
+
+// leafKeys lists the keys of a struct, descending into nested structs
+func leafKeys(t reflect.Type, prefix string) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := field.Tag.Get("mapstructure")
+		if key == "" {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.Struct:
+			keys = append(keys, leafKeys(field.Type, joinKey(prefix, key))...)
+		case reflect.Map:
+		default:
+			keys = append(keys, joinKey(prefix, key))
+		}
+	}
+	return keys
+}
+
+// EnvVar returns the environment variable that overrides a key, such as
+// WATERMARK_FONT_SIZE for font_size
+func EnvVar(key string) string {
+	return envPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// ApplyFlags overrides settings with the flags of the running command that
+// were given on the command line. keys maps flag names to configuration keys;
+// flags the command does not have are ignored.
+func (m *Manager) ApplyFlags(flags *pflag.FlagSet, keys map[string]string) error {
+	for name, key := range keys {
+		flag := flags.Lookup(name)
+		if flag == nil || !flag.Changed {
+			continue
+		}
+
+		var value interface{}
+		switch flag.Value.Type() {
+		case "stringArray":
+			value, _ = flags.GetStringArray(name)
+		case "stringSlice":
+			value, _ = flags.GetStringSlice(name)
+		default:
+			value = flag.Value.String()
+		}
+
+		// Redactions are given as "x,y,width,height[:mode]" on the command line
+		// and stored like the structured entries of the config file
+		if key == "redactions" {
+			entries, err := redactionEntries(value.([]string))
+			if err != nil {
+				return fmt.Errorf("parsing --%s: %w", name, err)
+			}
+			value = entries
+		}
+
+		m.viper.Set(key, value)
+		m.flags[key] = name
+	}
+
+	return m.unmarshal()
+}
+
+// redactionEntries converts redaction specifications to config file entries
+func redactionEntries(specs []string) ([]map[string]interface{}, error) {
+	entries := make([]map[string]interface{}, 0, len(specs))
+	for _, spec := range specs {
+		redaction, err := watermark.ParseRedaction(spec)
+		if err != nil {
+			return nil, err
+		}
+		size := redaction.Rect.Size()
+		entries = append(entries, map[string]interface{}{
+			"x":      redaction.Rect.Min.X,
+			"y":      redaction.Rect.Min.Y,
+			"width":  size.X,
+			"height": size.Y,
+			"mode":   string(redaction.Mode),
+		})
+	}
+	return entries, nil
+}
+
+// Source returns where the effective value of a key comes from. Later
+// sources take precedence: defaults, file, preset, env, flags.
+func (m *Manager) Source(key string) Source {
+	key = strings.ToLower(key)
+	if _, ok := m.flags[key]; ok {
+		return SourceFlag
+	}
+
+	switch {
+	case envSet(key):
+		return SourceEnv
+	case hasPath(m.profile, strings.Split(key, ".")):
+		return SourcePreset
+	case m.fileKeys[key]:
+		return SourceFile
+	default:
+		return SourceDefault
+	}
+}
+
+// Settings returns the effective value and source of every configuration key
+func (m *Manager) Settings() []Setting {
+	keys := Keys()
+	fields := fieldsByKey(reflect.TypeOf(AppConfig{}))
+	settings := make([]Setting, 0, len(keys))
+	for _, key := range keys {
+		setting := Setting{
+			Key:    key,
+			Value:  m.viper.Get(key),
+			Source: m.Source(key),
+		}
+		// Show colors given in the {r, g, b, a} form like other colors
+		if fields[key].Type == reflect.TypeOf(ColorSpec("")) {
+			if spec, err := colorSpec(setting.Value); err == nil {
+				setting.Value = spec
+			}
+		}
+		if setting.Source == SourceEnv {
+			setting.EnvVar = EnvVar(key)
+		}
+		settings = append(settings, setting)
+	}
+	return settings
+}
+
+// envSet reports whether the environment variable of a key is set
+func envSet(key string) bool {
+	_, ok := os.LookupEnv(EnvVar(key))
+	return ok
+}
+
+// hasPath reports whether a nested map contains a dotted path
+func hasPath(values map[string]interface{}, path []string) bool {
+	for i, part := range path {
+		var value interface{}
+		found := false
+		for k, v := range values {
+			if strings.EqualFold(k, part) {
+				value, found = v, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+		if i == len(path)-1 {
+			return true
+		}
+		if values, found = value.(map[string]interface{}); !found {
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,444 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/denysvitali/id-watermark/pkg/watermark"
+)
+
+// Problem is an issue found in a configuration file
+type Problem struct {
+	File    string
+	Line    int
+	Column  int
+	Key     string
+	Message string
+}
+
+// String formats the problem as "file:line:column: key: message"
+func (p Problem) String() string {
+	location := p.File
+	if p.Line > 0 {
+		location = fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+	}
+	if p.Key == "" {
+		return fmt.Sprintf("%s: %s", location, p.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", location, p.Key, p.Message)
+}
+
+// joinProblems formats problems on a single line, for error messages
+func joinProblems(problems []Problem) string {
+	messages := make([]string, 0, len(problems))
+	for _, problem := range problems {
+		messages = append(messages, problem.String())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// valueCheck checks a decoded setting, keyed by its path in AppConfig
+type valueCheck func(v *validator, node *yaml.Node, key string, value interface{}) error
+
+var valueChecks = map[string]valueCheck{
+	"font_path":         checkFontSpec,
+	"watermark_color":   checkColor,
+	"stroke_color":      checkColor,
+	"background_color":  checkColor,
+	"font_size":         checkLength("font size", 10, 200),
+	"text_spacing":      checkLength("text spacing", 5, 200),
+	"line_spacing":      checkLength("line spacing", 5, 200),
+	"quality":           checkIntRange(1, 100),
+	"log_level":         checkLogLevel,
+	"max_dimension":     checkIntRange(0, -1),
+	"target_dpi":        checkNonNegative,
+	"default_workers":   checkIntRange(1, -1),
+	"memory_budget":     checkByteSize,
+	"font_dirs":         checkFontDir,
+	"redactions.x":      checkIntRange(0, -1),
+	"redactions.y":      checkIntRange(0, -1),
+	"redactions.width":  checkIntRange(1, -1),
+	"redactions.height": checkIntRange(1, -1),
+	"redactions.mode":   checkRedactionMode,
+}
+
+// yamlErrorPattern extracts the line number from YAML syntax errors
+var yamlErrorPattern = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// fontRef is a font setting whose existence is checked once all font
+// directories of the file are known
+type fontRef struct {
+	node *yaml.Node
+	key  string
+	spec string
+}
+
+// validator walks a YAML document and collects problems
+type validator struct {
+	file     string
+	problems []Problem
+	fonts    []fontRef
+	fontDirs []string
+}
+
+// ValidateFile strictly checks a YAML or JSON configuration file. Unlike
+// LoadConfig, which ignores keys it does not know, every key must match a
+// setting and every value must have the right type and range. Font paths are
+// checked to exist.
+func ValidateFile(filename string) ([]Problem, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml", ".json", "":
+	default:
+		return nil, fmt.Errorf("only YAML and JSON configuration files can be validated, got %s", filename)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	v := &validator{file: filename}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		problem := Problem{File: filename, Message: err.Error()}
+		if match := yamlErrorPattern.FindStringSubmatch(err.Error()); match != nil {
+			problem.Line, _ = strconv.Atoi(match[1])
+			problem.Column = 1
+			problem.Message = match[2]
+		}
+		return []Problem{problem}, nil
+	}
+
+	// An empty file is a valid configuration that uses the defaults
+	if len(document.Content) == 0 {
+		return nil, nil
+	}
+
+	v.checkFields(document.Content[0], fieldsByKey(reflect.TypeOf(AppConfig{})), "", "")
+	v.checkFonts()
+
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		if v.problems[i].Line != v.problems[j].Line {
+			return v.problems[i].Line < v.problems[j].Line
+		}
+		return v.problems[i].Column < v.problems[j].Column
+	})
+
+	return v.problems, nil
+}
+
+// report records a problem at the position of node
+func (v *validator) report(node *yaml.Node, key, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{
+		File:    v.file,
+		Line:    node.Line,
+		Column:  node.Column,
+		Key:     key,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// checkFields checks a mapping against the fields of a struct. key is the
+// path shown to the user, while name is the path used to look up checks,
+// without list indexes and profile names.
+func (v *validator) checkFields(node *yaml.Node, fields map[string]reflect.StructField, key, name string) {
+	if node.Kind != yaml.MappingNode {
+		v.report(node, key, "expected a mapping, got %s", describeNode(node))
+		return
+	}
+
+	seen := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], node.Content[i+1]
+		fieldName := strings.ToLower(keyNode.Value)
+		fieldKey := joinKey(key, keyNode.Value)
+
+		if first, ok := seen[fieldName]; ok {
+			v.report(keyNode, fieldKey, "duplicate key, first defined on line %d", first.Line)
+			continue
+		}
+		seen[fieldName] = keyNode
+
+		field, ok := fields[fieldName]
+		if !ok {
+			message := "unknown key"
+			if suggestion := suggestKey(fieldName, fields); suggestion != "" {
+				message += fmt.Sprintf(", did you mean %q?", suggestion)
+			}
+			v.report(keyNode, fieldKey, message)
+			continue
+		}
+
+		v.checkValue(valueNode, field.Type, fieldKey, joinKey(name, fieldName))
+	}
+}
+
+// checkValue checks a value against the type of its field
+func (v *validator) checkValue(node *yaml.Node, t reflect.Type, key, name string) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	// Colors may also be given in the older {r, g, b, a} form
+	if t == reflect.TypeOf(ColorSpec("")) && node.Kind == yaml.MappingNode {
+		v.checkFields(node, fieldsByKey(reflect.TypeOf(legacyColor{})), key, name)
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		v.checkFields(node, fieldsByKey(t), key, name)
+
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			v.report(node, key, "expected a list, got %s", describeNode(node))
+			return
+		}
+		for i, item := range node.Content {
+			v.checkValue(item, t.Elem(), fmt.Sprintf("%s[%d]", key, i), name)
+		}
+
+	case reflect.Map:
+		// The only map is profiles, where each entry overrides top-level settings
+		if node.Kind != yaml.MappingNode {
+			v.report(node, key, "expected a mapping, got %s", describeNode(node))
+			return
+		}
+		fields := fieldsByKey(reflect.TypeOf(AppConfig{}))
+		delete(fields, name)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			v.checkFields(node.Content[i+1], fields, joinKey(key, node.Content[i].Value), "")
+		}
+
+	default:
+		if node.Kind != yaml.ScalarNode {
+			v.report(node, key, "expected %s, got %s", describeType(t), describeNode(node))
+			return
+		}
+		value := reflect.New(t)
+		if err := node.Decode(value.Interface()); err != nil {
+			v.report(node, key, "expected %s, got %q", describeType(t), node.Value)
+			return
+		}
+		if check, ok := valueChecks[name]; ok {
+			if err := check(v, node, key, value.Elem().Interface()); err != nil {
+				v.report(node, key, "%v", err)
+			}
+		}
+	}
+}
+
+// checkFonts checks that every font setting names a loadable font, searching
+// the default font directories and those configured in the file
+func (v *validator) checkFonts() {
+	if len(v.fonts) == 0 {
+		return
+	}
+
+	fontManager := watermark.NewFontManager()
+	fontManager.SetFontDirs(append(watermark.DefaultFontDirs(), v.fontDirs...))
+
+	for _, ref := range v.fonts {
+		if _, err := fontManager.LoadFontSpec(ref.spec); err != nil {
+			v.report(ref.node, ref.key, "%v", err)
+		}
+	}
+}
+
+// checkFontSpec checks that a font file exists and defers the lookup of
+// builtin and family names to checkFonts
+func checkFontSpec(v *validator, node *yaml.Node, key string, value interface{}) error {
+	spec := value.(string)
+	if spec == "" {
+		return nil
+	}
+
+	// Anything that looks like a path must exist, rather than being looked up as a family name
+	if !watermark.IsBuiltinFont(spec) && (strings.ContainsAny(spec, `/\`) || filepath.Ext(spec) != "") {
+		file := spec
+		if _, err := os.Stat(file); err != nil {
+			if i := strings.LastIndex(spec, "#"); i >= 0 {
+				file = spec[:i]
+			}
+		}
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("font file %s does not exist", file)
+		}
+	}
+
+	v.fonts = append(v.fonts, fontRef{node: node, key: key, spec: spec})
+	return nil
+}
+
+// checkFontDir checks that a font directory exists
+func checkFontDir(v *validator, _ *yaml.Node, _ string, value interface{}) error {
+	dir := value.(string)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("font directory %s does not exist", dir)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("font directory %s is not a directory", dir)
+	}
+	v.fontDirs = append(v.fontDirs, dir)
+	return nil
+}
+
+// checkColor checks a color in any form accepted by watermark.ParseColor
+func checkColor(_ *validator, _ *yaml.Node, _ string, value interface{}) error {
+	if spec := value.(ColorSpec); spec != "" {
+		_, _, err := watermark.ParseColor(string(spec))
+		return err
+	}
+	return nil
+}
+
+// checkLength checks a size in any of the units accepted by watermark.ParseLength
+func checkLength(name string, lo, hi float64) valueCheck {
+	return func(_ *validator, _ *yaml.Node, _ string, value interface{}) error {
+		length, err := watermark.ParseLength(value.(string))
+		if err != nil {
+			return err
+		}
+		return length.Validate(name, lo, hi)
+	}
+}
+
+// checkIntRange checks that an integer is within [lo, hi], where a negative
+// hi means there is no upper bound
+func checkIntRange(lo, hi int) valueCheck {
+	return func(_ *validator, _ *yaml.Node, _ string, value interface{}) error {
+		n := value.(int)
+		switch {
+		case hi < 0 && n < lo:
+			return fmt.Errorf("must be at least %d, got: %d", lo, n)
+		case hi >= 0 && (n < lo || n > hi):
+			return fmt.Errorf("must be between %d and %d, got: %d", lo, hi, n)
+		}
+		return nil
+	}
+}
+
+// checkNonNegative checks that a number is not negative
+func checkNonNegative(_ *validator, _ *yaml.Node, _ string, value interface{}) error {
+	if n := value.(float64); n < 0 {
+		return fmt.Errorf("cannot be negative, got: %g", n)
+	}
+	return nil
+}
+
+// checkByteSize checks a size in bytes as accepted by watermark.ParseByteSize
+func checkByteSize(_ *validator, _ *yaml.Node, _ string, value interface{}) error {
+	_, err := watermark.ParseByteSize(value.(string))
+	return err
+}
+
+// checkLogLevel checks that the log level is known to logrus
+func checkLogLevel(_ *validator, _ *yaml.Node, _ string, value interface{}) error {
+	_, err := logrus.ParseLevel(value.(string))
+	return err
+}
+
+// checkRedactionMode checks that a redaction mode is supported, an empty mode meaning fill
+func checkRedactionMode(_ *validator, _ *yaml.Node, _ string, value interface{}) error {
+	switch watermark.RedactionMode(value.(string)) {
+	case "", watermark.RedactFill, watermark.RedactPixelate, watermark.RedactBlur:
+		return nil
+	default:
+		return fmt.Errorf("unknown redaction mode %q (supported: fill, pixelate, blur)", value)
+	}
+}
+
+// fieldsByKey maps the mapstructure keys of a struct to its fields
+func fieldsByKey(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if key := field.Tag.Get("mapstructure"); key != "" {
+			fields[key] = field
+		}
+	}
+	return fields
+}
+
+// joinKey appends a key to a dotted path
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// describeNode names the kind of a YAML node for error messages
+func describeNode(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.SequenceNode:
+		return "a list"
+	default:
+		return fmt.Sprintf("%q", node.Value)
+	}
+}
+
+// describeType names the values accepted by a field for error messages
+func describeType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Uint8:
+		return "an integer between 0 and 255"
+	case reflect.Int:
+		return "an integer"
+	case reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	default:
+		return t.String()
+	}
+}
+
+// suggestKey returns the known key closest to an unknown one, if any is close enough
+func suggestKey(key string, fields map[string]reflect.StructField) string {
+	best, bestDistance := "", len(key)/3+1
+	for candidate := range fields {
+		if d := editDistance(key, candidate); d < bestDistance || (d == bestDistance && best != "" && candidate < best) {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
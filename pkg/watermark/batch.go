@@ -1,13 +1,16 @@
 package watermark
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/semaphore"
 )
 
 // BatchProcessor handles batch processing of multiple images
@@ -16,6 +19,24 @@ type BatchProcessor struct {
 	workers   int
 	recursive bool
 	logger    *logrus.Logger
+	dirConfig DirConfigFunc
+	dirs      map[string]*dirSettings
+	onEvent   EventFunc
+	eventMu   sync.Mutex
+	force     bool
+
+	filter         *fileFilter
+	maxDepth       int
+	followSymlinks bool
+
+	nameTemplate string
+	layout       Layout
+	format       string
+
+	// memory limits the estimated memory of the images in progress to
+	// memoryBudget bytes, when not nil
+	memory       *semaphore.Weighted
+	memoryBudget int64
 }
 
 // BatchOptions configures batch processing behavior
@@ -23,16 +44,55 @@ type BatchOptions struct {
 	Workers   int
 	Recursive bool
 	Logger    *logrus.Logger
+	// DirConfig creates the config for directories with a DirConfigFile.
+	// When nil, directory config files are ignored.
+	DirConfig DirConfigFunc
+	// OnEvent receives an event when a file is started and when it is done
+	OnEvent EventFunc
+	// Force reprocesses files that are unchanged since the last run, see StateFile
+	Force bool
+
+	// Include and Exclude are doublestar globs selecting the files of a
+	// directory, matched against paths relative to it with forward slashes.
+	// A pattern without a slash matches the name only, and an excluded
+	// directory is not searched. When Include is empty, every image is included.
+	Include []string
+	Exclude []string
+	// MaxDepth limits how deep a recursive batch searches, where the files of
+	// the input directory are at depth 1. Zero means no limit.
+	MaxDepth int
+	// FollowSymlinks follows symlinks to files and directories, which are
+	// skipped otherwise
+	FollowSymlinks bool
+
+	// NameTemplate names the outputs of a directory, see DefaultNameTemplate.
+	// It may use {stem}, {ext}, {date}, {company} and {hash8}, the first 8
+	// hex digits of the SHA-256 hash of the input.
+	NameTemplate string
+	// Layout arranges the outputs of a directory, mirroring the input tree
+	// by default. Outputs that would get the same name are numbered.
+	Layout Layout
+	// Format converts every output of a directory to jpeg or png. When
+	// empty, outputs keep the format of their input.
+	Format string
+
+	// MemoryBudget limits the memory of the images processed at once, in
+	// bytes, as estimated from their dimensions. Workers wait for large
+	// images to finish before starting more. Zero means no limit.
+	MemoryBudget int64
 }
 
-// NewBatchProcessor creates a new batch processor
+// NewBatchProcessor creates a new batch processor. The config may be nil
+// when only jobs with their own config are processed.
 func NewBatchProcessor(config *Config, options *BatchOptions) (*BatchProcessor, error) {
-	if err := ValidateConfig(config); err != nil {
-		return nil, fmt.Errorf("invalid config: %w", err)
+	var processor *Processor
+	if config != nil {
+		if err := ValidateConfig(config); err != nil {
+			return nil, fmt.Errorf("invalid config: %w", err)
+		}
+		processor = NewProcessor(config)
 	}
 
-	processor := NewProcessor(config)
-
 	workers := options.Workers
 	if workers <= 0 {
 		workers = 4
@@ -43,16 +103,47 @@ func NewBatchProcessor(config *Config, options *BatchOptions) (*BatchProcessor,
 		logger = logrus.New()
 	}
 
-	return &BatchProcessor{
+	filter, err := newFileFilter(options.Include, options.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := newOutputNamer(options.NameTemplate, options.Layout, options.Format); err != nil {
+		return nil, err
+	}
+
+	bp := &BatchProcessor{
 		processor: processor,
 		workers:   workers,
 		recursive: options.Recursive,
 		logger:    logger,
-	}, nil
+		dirConfig: options.DirConfig,
+		dirs:      make(map[string]*dirSettings),
+		onEvent:   options.OnEvent,
+		force:     options.Force,
+
+		filter:         filter,
+		maxDepth:       options.MaxDepth,
+		followSymlinks: options.FollowSymlinks,
+
+		nameTemplate: options.NameTemplate,
+		layout:       options.Layout,
+		format:       options.Format,
+	}
+	if options.MemoryBudget > 0 {
+		bp.memory = semaphore.NewWeighted(options.MemoryBudget)
+		bp.memoryBudget = options.MemoryBudget
+	}
+	return bp, nil
 }
 
-// ProcessDirectory processes all images in a directory
-func (bp *BatchProcessor) ProcessDirectory(inputDir, outputDir string) (*BatchResult, error) {
+// ProcessDirectory processes all images in a directory. When ctx is
+// cancelled, files in progress are stopped, no more files are started, and
+// the partial result is returned with the cancellation error.
+func (bp *BatchProcessor) ProcessDirectory(ctx context.Context, inputDir, outputDir string) (*BatchResult, error) {
+	if bp.processor == nil {
+		return nil, fmt.Errorf("processing a directory requires a config")
+	}
+
 	// Find all image files
 	imageFiles, err := bp.findImageFiles(inputDir)
 	if err != nil {
@@ -63,6 +154,34 @@ func (bp *BatchProcessor) ProcessDirectory(inputDir, outputDir string) (*BatchRe
 		return nil, fmt.Errorf("no image files found in %s", inputDir)
 	}
 
+	return bp.processDirectory(ctx, inputDir, outputDir, imageFiles)
+}
+
+// ProcessFileList processes the listed files of a directory instead of
+// searching it. Relative paths are relative to the working directory, every
+// file must be inside the input directory, and the include and exclude
+// patterns still apply. Files listed more than once are processed once.
+// Outputs are laid out as for ProcessDirectory.
+func (bp *BatchProcessor) ProcessFileList(ctx context.Context, inputDir, outputDir string, files []string) (*BatchResult, error) {
+	if bp.processor == nil {
+		return nil, fmt.Errorf("processing a directory requires a config")
+	}
+
+	imageFiles, err := bp.listedImageFiles(inputDir, files)
+	if err != nil {
+		return nil, fmt.Errorf("reading file list: %w", err)
+	}
+
+	if len(imageFiles) == 0 {
+		return nil, fmt.Errorf("no image files listed")
+	}
+
+	return bp.processDirectory(ctx, inputDir, outputDir, imageFiles)
+}
+
+// processDirectory processes image files of the input directory into the
+// output directory, named and arranged as configured
+func (bp *BatchProcessor) processDirectory(ctx context.Context, inputDir, outputDir string, imageFiles []string) (*BatchResult, error) {
 	bp.logger.WithFields(logrus.Fields{
 		"input_dir":  inputDir,
 		"output_dir": outputDir,
@@ -76,15 +195,42 @@ func (bp *BatchProcessor) ProcessDirectory(inputDir, outputDir string) (*BatchRe
 		return nil, fmt.Errorf("creating output directory: %w", err)
 	}
 
-	// Process files
-	result := bp.processFiles(imageFiles, inputDir, outputDir)
+	// Files processed before with the same settings are skipped
+	state, err := loadState(outputDir)
+	if err != nil {
+		return nil, err
+	}
 
-	bp.logger.WithFields(logrus.Fields{
+	// Process files. The options were validated when the batch processor
+	// was created.
+	namer, _ := newOutputNamer(bp.nameTemplate, bp.layout, bp.format)
+	result := bp.processFiles(ctx, namer, imageFiles, inputDir, outputDir, state)
+	if err := state.close(); err != nil {
+		return nil, err
+	}
+
+	return bp.finish(ctx, result)
+}
+
+// finish logs the outcome of a batch and counts the files left unprocessed
+// when it was cancelled. A cancelled batch returns its partial result with
+// the cancellation error.
+func (bp *BatchProcessor) finish(ctx context.Context, result *BatchResult) (*BatchResult, error) {
+	result.CanceledCount = result.TotalCount - result.SuccessCount - result.ErrorCount - result.SkippedCount
+
+	fields := logrus.Fields{
 		"success": result.SuccessCount,
+		"skipped": result.SkippedCount,
 		"errors":  result.ErrorCount,
 		"total":   result.TotalCount,
-	}).Info("Batch processing completed")
+	}
+	if err := ctx.Err(); err != nil {
+		fields["canceled"] = result.CanceledCount
+		bp.logger.WithFields(fields).Warn("Batch processing interrupted")
+		return result, fmt.Errorf("batch interrupted: %w", err)
+	}
 
+	bp.logger.WithFields(fields).Info("Batch processing completed")
 	return result, nil
 }
 
@@ -93,58 +239,190 @@ type BatchResult struct {
 	TotalCount   int
 	SuccessCount int
 	ErrorCount   int
-	Errors       []BatchError
+	// SkippedCount is the number of files unchanged since the last run
+	SkippedCount int
+	// CanceledCount is the number of files not processed because the batch
+	// was cancelled
+	CanceledCount int
+	Errors        []BatchError
+	Files         []FileResult
+	// Skipped are the input paths of the skipped files
+	Skipped []string
 }
 
 // BatchError represents an error that occurred during batch processing
 type BatchError struct {
-	FilePath string
-	Error    error
+	FilePath   string
+	OutputPath string
+	Error      error
+	// Class is the stage that failed, see ClassOf
+	Class ErrorClass
+	// Duration is how long the file was processed before it failed
+	Duration time.Duration
+	// Overrides are the directory config files that applied to the file
+	Overrides []string
+}
+
+// Job is a single image of a batch with its own output path and config
+type Job struct {
+	InputPath  string
+	OutputPath string
+	// Config creates the config of the job. Its errors are reported for the
+	// job in the result. When nil, the config of the batch processor is used.
+	Config func() (*Config, error)
+}
+
+// ProcessJobs processes a list of jobs, such as those of a job manifest.
+// Output directories are created as needed. Cancellation works as for
+// ProcessDirectory.
+func (bp *BatchProcessor) ProcessJobs(ctx context.Context, jobs []Job) (*BatchResult, error) {
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("no jobs to process")
+	}
+
+	bp.logger.WithFields(logrus.Fields{
+		"jobs":    len(jobs),
+		"workers": bp.workers,
+	}).Info("Starting batch processing")
+
+	result := bp.run(ctx, len(jobs), nil, func(send chan<- job) {
+		// Configs are created here rather than in the workers, so Config
+		// functions need not be safe for concurrent use
+		for _, j := range jobs {
+			if ctx.Err() != nil {
+				return
+			}
+
+			next := job{
+				inputPath:  j.InputPath,
+				outputPath: j.OutputPath,
+				processor:  bp.processor,
+			}
+			switch {
+			case j.Config != nil:
+				next.processor, next.err = jobProcessor(j.Config)
+			case bp.processor == nil:
+				next.err = classify(ErrorClassConfig, fmt.Errorf("job has no config"))
+			}
+			if next.err == nil {
+				if err := os.MkdirAll(filepath.Dir(j.OutputPath), 0755); err != nil {
+					next.err = classify(ErrorClassOutput, fmt.Errorf("creating output directory: %w", err))
+				}
+			}
+			send <- next
+		}
+	})
+
+	return bp.finish(ctx, result)
+}
+
+// jobProcessor creates the processor of a job from its config
+func jobProcessor(create func() (*Config, error)) (*Processor, error) {
+	config, err := create()
+	if err != nil {
+		return nil, classify(ErrorClassConfig, err)
+	}
+	if err := ValidateConfig(config); err != nil {
+		return nil, classify(ErrorClassConfig, fmt.Errorf("invalid config: %w", err))
+	}
+	return NewProcessor(config), nil
 }
 
 // job represents a single processing job
 type job struct {
 	inputPath  string
 	outputPath string
+	processor  *Processor
+	overrides  []string
+	err        error
+
+	// statePath is the output path relative to the output directory, and
+	// previous the state entry of the output from an earlier run, if any
+	statePath string
+	previous  *stateEntry
 }
 
 // jobResult represents the result of a single job
 type jobResult struct {
-	inputPath string
-	err       error
+	inputPath  string
+	outputPath string
+	overrides  []string
+	duration   time.Duration
+	file       *FileResult
+	err        error
+	skipped    bool
+	statePath  string
+	configHash string
 }
 
 // processFiles processes a list of image files using worker goroutines
-func (bp *BatchProcessor) processFiles(imageFiles []string, inputDir, outputDir string) *BatchResult {
-	jobs := make(chan job, len(imageFiles))
-	results := make(chan jobResult, len(imageFiles))
+func (bp *BatchProcessor) processFiles(ctx context.Context, namer *outputNamer, imageFiles []string, inputDir, outputDir string, state *batchState) *BatchResult {
+	return bp.run(ctx, len(imageFiles), state, func(send chan<- job) {
+		for _, file := range imageFiles {
+			if ctx.Err() != nil {
+				return
+			}
+
+			relPath, err := filepath.Rel(inputDir, file)
+			if err != nil {
+				relPath = filepath.Base(file)
+			}
+
+			// Directory settings and output names are resolved here rather
+			// than in the workers, so the cache and the taken names need no
+			// locking
+			next := job{
+				inputPath: file,
+				processor: bp.processor,
+			}
+			if bp.dirConfig != nil {
+				settings := bp.dirSettings(filepath.Dir(file), inputDir)
+				next.processor, next.overrides, next.err = settings.processor, settings.files, settings.err
+			}
+
+			company := bp.processor.config.CompanyName
+			if next.processor != nil {
+				company = next.processor.config.CompanyName
+			}
+			var inputHash string
+			if namer.usesHash() {
+				inputHash = hashFile(file)
+			}
+			outputName := namer.name(filepath.ToSlash(relPath), company, inputHash)
+			outputPath := filepath.Join(outputDir, filepath.FromSlash(outputName))
+			next.outputPath = outputPath
+
+			// Create output subdirectory if needed
+			if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil && next.err == nil {
+				next.err = classify(ErrorClassOutput, fmt.Errorf("creating output directory: %w", err))
+			}
+			if state != nil {
+				next.statePath = outputName
+				if entry, ok := state.entries[next.statePath]; ok && !bp.force {
+					next.previous = &entry
+				}
+			}
+			send <- next
+		}
+	})
+}
+
+// run processes the jobs sent by send using worker goroutines. total is the
+// number of jobs, and send returns once every job is sent. Processed files
+// are recorded in state, when not nil.
+func (bp *BatchProcessor) run(ctx context.Context, total int, state *batchState, send func(chan<- job)) *BatchResult {
+	jobs := make(chan job, total)
+	results := make(chan jobResult, total)
 
 	// Start workers
 	var wg sync.WaitGroup
 	for i := 0; i < bp.workers; i++ {
 		wg.Add(1)
-		go bp.worker(jobs, results, &wg)
+		go bp.worker(ctx, jobs, results, total, &wg)
 	}
 
 	// Send jobs
-	for _, file := range imageFiles {
-		relPath, err := filepath.Rel(inputDir, file)
-		if err != nil {
-			relPath = filepath.Base(file)
-		}
-		outputPath := filepath.Join(outputDir, relPath)
-
-		// Create output subdirectory if needed
-		if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
-			bp.logger.WithError(err).WithField("path", filepath.Dir(outputPath)).Warn("Failed to create output directory")
-			continue
-		}
-
-		jobs <- job{
-			inputPath:  file,
-			outputPath: outputPath,
-		}
-	}
+	send(jobs)
 	close(jobs)
 
 	// Wait for workers to finish
@@ -155,21 +433,49 @@ func (bp *BatchProcessor) processFiles(imageFiles []string, inputDir, outputDir
 
 	// Collect results
 	result := &BatchResult{
-		TotalCount: len(imageFiles),
+		TotalCount: total,
 		Errors:     make([]BatchError, 0),
+		Files:      make([]FileResult, 0, total),
 	}
 
 	for jobResult := range results {
+		if jobResult.skipped {
+			result.SkippedCount++
+			result.Skipped = append(result.Skipped, jobResult.inputPath)
+			bp.logger.WithField("file", jobResult.inputPath).Debug("Skipped unchanged image")
+			continue
+		}
+
 		if jobResult.err != nil {
 			result.ErrorCount++
 			result.Errors = append(result.Errors, BatchError{
-				FilePath: jobResult.inputPath,
-				Error:    jobResult.err,
+				FilePath:   jobResult.inputPath,
+				OutputPath: jobResult.outputPath,
+				Error:      jobResult.err,
+				Class:      ClassOf(jobResult.err),
+				Duration:   jobResult.duration,
+				Overrides:  jobResult.overrides,
 			})
 			bp.logger.WithError(jobResult.err).WithField("file", jobResult.inputPath).Error("Failed to process image")
 		} else {
 			result.SuccessCount++
-			bp.logger.WithField("file", jobResult.inputPath).Debug("Successfully processed image")
+			result.Files = append(result.Files, *jobResult.file)
+			if state != nil && jobResult.configHash != "" {
+				err := state.record(stateEntry{
+					Output:     jobResult.statePath,
+					InputHash:  jobResult.file.InputHash,
+					ConfigHash: jobResult.configHash,
+					OutputHash: jobResult.file.OutputHash,
+				})
+				if err != nil {
+					bp.logger.WithError(err).Warn("Failed to update state file")
+				}
+			}
+			bp.logger.WithFields(logrus.Fields{
+				"file":          jobResult.inputPath,
+				"original_size": jobResult.file.OriginalSize,
+				"final_size":    jobResult.file.FinalSize,
+			}).Debug("Successfully processed image")
 		}
 	}
 
@@ -177,46 +483,78 @@ func (bp *BatchProcessor) processFiles(imageFiles []string, inputDir, outputDir
 }
 
 // worker processes jobs from the job channel
-func (bp *BatchProcessor) worker(jobs <-chan job, results chan<- jobResult, wg *sync.WaitGroup) {
+func (bp *BatchProcessor) worker(ctx context.Context, jobs <-chan job, results chan<- jobResult, total int, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	for job := range jobs {
-		err := bp.processor.ProcessFile(job.inputPath, job.outputPath)
-		results <- jobResult{
-			inputPath: job.inputPath,
-			err:       err,
+		// Jobs left when the batch is cancelled are counted as cancelled
+		if ctx.Err() != nil {
+			continue
 		}
-	}
-}
 
-// findImageFiles finds all image files in the given directory
-func (bp *BatchProcessor) findImageFiles(inputDir string) ([]string, error) {
-	var imageFiles []string
-	supportedExts := []string{".jpg", ".jpeg", ".png"}
+		event := Event{
+			Type:       EventStarted,
+			InputPath:  job.inputPath,
+			OutputPath: job.outputPath,
+			Total:      total,
+		}
 
-	err := filepath.Walk(inputDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+		var configHash string
+		if job.processor != nil {
+			configHash = job.processor.config.Fingerprint
+		}
+		if job.err == nil && job.previous != nil && job.previous.unchanged(job.inputPath, job.outputPath, configHash) {
+			event.Type = EventSkipped
+			bp.emit(event)
+			results <- jobResult{inputPath: job.inputPath, outputPath: job.outputPath, skipped: true}
+			continue
 		}
 
-		if info.IsDir() {
-			// Skip subdirectories if not recursive
-			if !bp.recursive && path != inputDir {
-				return filepath.SkipDir
+		// Large images wait for memory before they are started
+		release := func() {}
+		if job.err == nil {
+			var err error
+			if release, err = bp.reserve(ctx, job.inputPath); err != nil {
+				continue
 			}
-			return nil
 		}
 
-		ext := strings.ToLower(filepath.Ext(path))
-		for _, supportedExt := range supportedExts {
-			if ext == supportedExt {
-				imageFiles = append(imageFiles, path)
-				break
-			}
+		bp.emit(event)
+		start := time.Now()
+
+		var file *FileResult
+		err := job.err
+		if err == nil {
+			file, err = job.processor.Process(ctx, job.inputPath, job.outputPath)
+		}
+		release()
+		if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			event.Type = EventCanceled
+			bp.emit(event)
+			continue
+		}
+		if file != nil {
+			file.Overrides = job.overrides
 		}
 
-		return nil
-	})
+		event.Type, event.Duration = EventFinished, time.Since(start)
+		event.InputBytes = fileSize(job.inputPath)
+		if err != nil {
+			event.Type, event.Err = EventFailed, err
+		} else {
+			event.OutputBytes = fileSize(job.outputPath)
+		}
+		bp.emit(event)
 
-	return imageFiles, err
+		results <- jobResult{
+			inputPath:  job.inputPath,
+			outputPath: job.outputPath,
+			overrides:  job.overrides,
+			duration:   event.Duration,
+			file:       file,
+			err:        err,
+			statePath:  job.statePath,
+			configHash: configHash,
+		}
+	}
 }
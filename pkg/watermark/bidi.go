@@ -0,0 +1,353 @@
+package watermark
+
+import (
+	"slices"
+
+	"golang.org/x/text/unicode/bidi"
+)
+
+// mirroredRunes maps characters to their mirror image, used for characters
+// that end up in right-to-left runs (UAX #9 rule L4)
+var mirroredRunes = map[rune]rune{
+	'(': ')', ')': '(',
+	'[': ']', ']': '[',
+	'{': '}', '}': '{',
+	'<': '>', '>': '<',
+	'«': '»', '»': '«',
+	'‹': '›', '›': '‹',
+}
+
+// reorderBidi converts a single line of text from logical to visual order
+// following the Unicode Bidirectional Algorithm (UAX #9). Explicit embedding
+// and isolate controls are not supported and are removed.
+func reorderBidi(text string) string {
+	runes := make([]rune, 0, len(text))
+	classes := make([]bidi.Class, 0, len(text))
+	for _, r := range text {
+		props, _ := bidi.LookupRune(r)
+		switch class := props.Class(); class {
+		case bidi.LRE, bidi.RLE, bidi.LRO, bidi.RLO, bidi.PDF, bidi.LRI, bidi.RLI, bidi.FSI, bidi.PDI, bidi.BN:
+			continue
+		default:
+			runes = append(runes, r)
+			classes = append(classes, class)
+		}
+	}
+
+	if !hasRTL(classes) {
+		return string(runes)
+	}
+
+	paragraphLevel := paragraphLevel(classes)
+	levels := resolveLevels(runes, classes, paragraphLevel)
+
+	// L1: trailing whitespace is reset to the paragraph level
+	for i := len(classes) - 1; i >= 0 && (classes[i] == bidi.WS || classes[i] == bidi.S); i-- {
+		levels[i] = paragraphLevel
+	}
+
+	// L4: mirror characters in right-to-left runs
+	for i, r := range runes {
+		if levels[i]%2 == 1 {
+			if mirrored, ok := mirroredRunes[r]; ok {
+				runes[i] = mirrored
+			}
+		}
+	}
+
+	// L2: reverse every run at or above each level, from the highest level
+	// down to the lowest odd level
+	highest := 0
+	for _, level := range levels {
+		highest = max(highest, level)
+	}
+	lowestOdd := highest + 1
+	for _, level := range levels {
+		if level%2 == 1 {
+			lowestOdd = min(lowestOdd, level)
+		}
+	}
+
+	for level := highest; level >= lowestOdd; level-- {
+		for i := 0; i < len(runes); {
+			if levels[i] < level {
+				i++
+				continue
+			}
+			j := i
+			for j < len(runes) && levels[j] >= level {
+				j++
+			}
+			slices.Reverse(runes[i:j])
+			slices.Reverse(levels[i:j])
+			i = j
+		}
+	}
+
+	return string(runes)
+}
+
+// hasRTL reports whether any character is strongly right-to-left or an Arabic number
+func hasRTL(classes []bidi.Class) bool {
+	for _, class := range classes {
+		if class == bidi.R || class == bidi.AL || class == bidi.AN {
+			return true
+		}
+	}
+	return false
+}
+
+// paragraphLevel finds the paragraph embedding level from the first strong character (rules P2, P3)
+func paragraphLevel(classes []bidi.Class) int {
+	for _, class := range classes {
+		switch class {
+		case bidi.L:
+			return 0
+		case bidi.R, bidi.AL:
+			return 1
+		}
+	}
+	return 0
+}
+
+// resolveLevels resolves weak types, neutral types and implicit levels for a
+// single isolating run sequence (rules W1-W7, N0-N2 and I1-I2)
+func resolveLevels(runes []rune, input []bidi.Class, paragraphLevel int) []int {
+	types := append([]bidi.Class(nil), input...)
+	sos := bidi.L
+	if paragraphLevel%2 == 1 {
+		sos = bidi.R
+	}
+
+	// W1: non-spacing marks take the type of the previous character
+	for i, t := range types {
+		if t == bidi.NSM {
+			if i == 0 {
+				types[i] = sos
+			} else {
+				types[i] = types[i-1]
+			}
+		}
+	}
+
+	// W2: European numbers after Arabic letters become Arabic numbers
+	// W3: Arabic letters become right-to-left
+	lastStrong := sos
+	for i, t := range types {
+		switch t {
+		case bidi.L, bidi.R, bidi.AL:
+			lastStrong = t
+		case bidi.EN:
+			if lastStrong == bidi.AL {
+				types[i] = bidi.AN
+			}
+		}
+	}
+	for i, t := range types {
+		if t == bidi.AL {
+			types[i] = bidi.R
+		}
+	}
+
+	// W4: a single separator between two numbers of the same kind joins them
+	for i := 1; i+1 < len(types); i++ {
+		prev, next := types[i-1], types[i+1]
+		switch {
+		case types[i] == bidi.ES && prev == bidi.EN && next == bidi.EN:
+			types[i] = bidi.EN
+		case types[i] == bidi.CS && prev == bidi.EN && next == bidi.EN:
+			types[i] = bidi.EN
+		case types[i] == bidi.CS && prev == bidi.AN && next == bidi.AN:
+			types[i] = bidi.AN
+		}
+	}
+
+	// W5: terminators adjacent to European numbers become European numbers
+	for i := 0; i < len(types); i++ {
+		if types[i] != bidi.ET {
+			continue
+		}
+		j := i
+		for j < len(types) && types[j] == bidi.ET {
+			j++
+		}
+		if (i > 0 && types[i-1] == bidi.EN) || (j < len(types) && types[j] == bidi.EN) {
+			for k := i; k < j; k++ {
+				types[k] = bidi.EN
+			}
+		}
+		i = j
+	}
+
+	// W6: remaining separators and terminators become neutral
+	for i, t := range types {
+		if t == bidi.ES || t == bidi.ET || t == bidi.CS {
+			types[i] = bidi.ON
+		}
+	}
+
+	// W7: European numbers after left-to-right text become left-to-right
+	lastStrong = sos
+	for i, t := range types {
+		switch t {
+		case bidi.L, bidi.R:
+			lastStrong = t
+		case bidi.EN:
+			if lastStrong == bidi.L {
+				types[i] = bidi.L
+			}
+		}
+	}
+
+	resolveBrackets(runes, input, types, sos)
+
+	// N1, N2: neutrals take the direction of the surrounding strong text when
+	// both sides agree, and the embedding direction otherwise
+	for i := 0; i < len(types); i++ {
+		if strongDirection(types[i]) != bidi.ON {
+			continue
+		}
+		j := i
+		for j < len(types) && strongDirection(types[j]) == bidi.ON {
+			j++
+		}
+
+		before, after := sos, sos
+		if i > 0 {
+			before = strongDirection(types[i-1])
+		}
+		if j < len(types) {
+			after = strongDirection(types[j])
+		}
+
+		resolved := sos
+		if before == after {
+			resolved = before
+		}
+		for k := i; k < j; k++ {
+			types[k] = resolved
+		}
+		i = j
+	}
+
+	// I1, I2: implicit levels
+	levels := make([]int, len(types))
+	for i, t := range types {
+		level := paragraphLevel
+		if level%2 == 0 {
+			switch t {
+			case bidi.R:
+				level++
+			case bidi.AN, bidi.EN:
+				level += 2
+			}
+		} else if t == bidi.L || t == bidi.EN || t == bidi.AN {
+			level++
+		}
+		levels[i] = level
+	}
+
+	return levels
+}
+
+// strongDirection returns the direction a resolved type counts as for the
+// neutral rules, where numbers count as right-to-left, or ON for neutrals
+func strongDirection(t bidi.Class) bidi.Class {
+	switch t {
+	case bidi.L:
+		return bidi.L
+	case bidi.R, bidi.EN, bidi.AN:
+		return bidi.R
+	default:
+		return bidi.ON
+	}
+}
+
+// maxBracketDepth is the size of the bracket stack of rule BD16, beyond
+// which no more pairs are looked for
+const maxBracketDepth = 63
+
+// bracketPairs finds the paired brackets of a line (rule BD16), as the
+// indexes of the opening and closing bracket sorted by opening bracket.
+// Only brackets that are still neutral are paired.
+func bracketPairs(runes []rune, types []bidi.Class) [][2]int {
+	var stack []int
+	var pairs [][2]int
+	for i, r := range runes {
+		if types[i] != bidi.ON {
+			continue
+		}
+		props, _ := bidi.LookupRune(r)
+		switch {
+		case props.IsOpeningBracket():
+			if len(stack) == maxBracketDepth {
+				return sortPairs(pairs)
+			}
+			stack = append(stack, i)
+		case props.IsBracket():
+			// A closing bracket closes the nearest matching opening bracket,
+			// discarding the unmatched ones opened after it
+			for j := len(stack) - 1; j >= 0; j-- {
+				if mirroredRunes[runes[stack[j]]] == r {
+					pairs = append(pairs, [2]int{stack[j], i})
+					stack = stack[:j]
+					break
+				}
+			}
+		}
+	}
+	return sortPairs(pairs)
+}
+
+// sortPairs sorts bracket pairs by the position of their opening bracket
+func sortPairs(pairs [][2]int) [][2]int {
+	slices.SortFunc(pairs, func(a, b [2]int) int { return a[0] - b[0] })
+	return pairs
+}
+
+// resolveBrackets resolves paired brackets to the direction of the text they
+// enclose (rule N0), so both brackets of a pair get the same direction and
+// are mirrored together
+func resolveBrackets(runes []rune, input, types []bidi.Class, sos bidi.Class) {
+	embedding := sos
+	for _, pair := range bracketPairs(runes, types) {
+		opening, closing := pair[0], pair[1]
+
+		// N0 b, c: strong text inside the brackets matching the embedding
+		// direction wins, otherwise the opposite direction is used when the
+		// text before the brackets has it too
+		found := bidi.ON
+		for _, t := range types[opening+1 : closing] {
+			if d := strongDirection(t); d == embedding {
+				found = embedding
+				break
+			} else if d != bidi.ON {
+				found = d
+			}
+		}
+		if found == bidi.ON {
+			// N0 d: no strong text inside, leave the brackets to N1 and N2
+			continue
+		}
+		if found != embedding {
+			before := sos
+			for i := opening - 1; i >= 0; i-- {
+				if d := strongDirection(types[i]); d != bidi.ON {
+					before = d
+					break
+				}
+			}
+			if before != found {
+				found = embedding
+			}
+		}
+
+		// Non-spacing marks after a bracket take its new direction
+		for _, i := range []int{opening, closing} {
+			types[i] = found
+			for j := i + 1; j < len(types) && input[j] == bidi.NSM; j++ {
+				types[j] = found
+			}
+		}
+	}
+}
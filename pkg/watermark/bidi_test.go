@@ -0,0 +1,29 @@
+package watermark
+
+import "testing"
+
+func TestReorderBidi(t *testing.T) {
+	tests := []struct {
+		name    string
+		logical string
+		visual  string
+	}{
+		{"left-to-right only", "ACME - 2026-10-16", "ACME - 2026-10-16"},
+		{"hebrew between dates", "ACME - שלום - 2026-10-16", "ACME - 2026-10-16 - םולש"},
+		{"right-to-left paragraph", "שלום ACME 42", "ACME 42 םולש"},
+		{"arabic with european number", "ACME مرحبا 123", "ACME 123 ابحرم"},
+		{"arabic with arabic-indic number", "مرحبا ١٢٣ ACME", "ACME ١٢٣ ابحرم"},
+		{"brackets around right-to-left text", "ACME (שלום) 2026", "ACME (םולש) 2026"},
+		{"brackets in right-to-left paragraph", "(שלום)", "(םולש)"},
+		{"brackets around left-to-right text", "שלום (ACME) עולם", "םלוע (ACME) םולש"},
+		{"explicit controls removed", "ACME ‫שלום‬", "ACME םולש"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reorderBidi(tt.logical); got != tt.visual {
+				t.Errorf("reorderBidi(%q) = %q, want %q", tt.logical, got, tt.visual)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package watermark
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-fonts/liberation/liberationmonoregular"
+	"github.com/go-fonts/liberation/liberationsansbold"
+	"github.com/go-fonts/liberation/liberationsansregular"
+	"github.com/go-fonts/liberation/liberationserifregular"
+	"golang.org/x/image/font/opentype"
+)
+
+// BuiltinPrefix selects an embedded font instead of a font file, e.g. "builtin:sans"
+const BuiltinPrefix = "builtin:"
+
+// DefaultBuiltinFont is the embedded font used when no other font can be loaded
+const DefaultBuiltinFont = "sans"
+
+// builtinFonts holds the embedded Liberation fonts, released under the SIL
+// Open Font License, so the tool works without any fonts installed
+var builtinFonts = map[string][]byte{
+	"sans":      liberationsansregular.TTF,
+	"sans-bold": liberationsansbold.TTF,
+	"serif":     liberationserifregular.TTF,
+	"mono":      liberationmonoregular.TTF,
+}
+
+// BuiltinFontNames returns the names of the embedded fonts
+func BuiltinFontNames() []string {
+	names := make([]string, 0, len(builtinFonts))
+	for name := range builtinFonts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsBuiltinFont reports whether the font path refers to an embedded font
+func IsBuiltinFont(fontPath string) bool {
+	return strings.HasPrefix(fontPath, BuiltinPrefix)
+}
+
+// loadBuiltinFont parses an embedded font by name
+func loadBuiltinFont(name string) (*opentype.Font, error) {
+	data, ok := builtinFonts[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown builtin font %q (available: %s)", name, strings.Join(BuiltinFontNames(), ", "))
+	}
+
+	font, err := opentype.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing builtin font %s: %w", name, err)
+	}
+
+	return font, nil
+}
@@ -0,0 +1,133 @@
+package watermark
+
+import (
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/colornames"
+)
+
+// extraColorNames are CSS color names missing from the SVG 1.1 list
+var extraColorNames = map[string]color.NRGBA{
+	"rebeccapurple": {R: 0x66, G: 0x33, B: 0x99, A: 0xff},
+	"transparent":   {},
+}
+
+// ParseColor parses a color given as "#RGB", "#RGBA", "#RRGGBB",
+// "#RRGGBBAA", a CSS color name, "rgb(r, g, b)" or "rgba(r, g, b, a)".
+// Channels in rgb() may be 0-255 or percentages, and the alpha of rgba() is
+// 0-1 or a percentage. The second result reports whether the color has an
+// explicit alpha; colors without one are drawn with the configured opacity.
+func ParseColor(s string) (color.NRGBA, bool, error) {
+	input := s
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	switch {
+	case strings.HasPrefix(s, "#"):
+		c, hasAlpha, ok := parseHexColor(s[1:])
+		if !ok {
+			return color.NRGBA{}, false, fmt.Errorf("invalid color %q (expected #RGB, #RRGGBB or #RRGGBBAA)", input)
+		}
+		return c, hasAlpha, nil
+
+	case strings.HasPrefix(s, "rgb(") || strings.HasPrefix(s, "rgba("):
+		c, hasAlpha, err := parseRGBFunction(s)
+		if err != nil {
+			return color.NRGBA{}, false, fmt.Errorf("invalid color %q: %w", input, err)
+		}
+		return c, hasAlpha, nil
+
+	default:
+		if c, ok := colornames.Map[s]; ok {
+			return color.NRGBA{R: c.R, G: c.G, B: c.B, A: 0xff}, false, nil
+		}
+		if c, ok := extraColorNames[s]; ok {
+			return c, s == "transparent", nil
+		}
+		return color.NRGBA{}, false, fmt.Errorf("invalid color %q (expected #RRGGBB, #RRGGBBAA, a CSS color name or rgba())", input)
+	}
+}
+
+// parseHexColor parses the digits of a hex color in the short or long form
+func parseHexColor(digits string) (color.NRGBA, bool, bool) {
+	// Expand the short forms, "#abc" being "#aabbcc"
+	if len(digits) == 3 || len(digits) == 4 {
+		var expanded strings.Builder
+		for _, d := range digits {
+			expanded.WriteRune(d)
+			expanded.WriteRune(d)
+		}
+		digits = expanded.String()
+	}
+	if len(digits) != 6 && len(digits) != 8 {
+		return color.NRGBA{}, false, false
+	}
+
+	value, err := strconv.ParseUint(digits, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, false, false
+	}
+
+	if len(digits) == 6 {
+		value = value<<8 | 0xff
+	}
+	c := color.NRGBA{R: uint8(value >> 24), G: uint8(value >> 16), B: uint8(value >> 8), A: uint8(value)}
+	return c, len(digits) == 8, true
+}
+
+// parseRGBFunction parses the CSS rgb() and rgba() functional notations
+func parseRGBFunction(s string) (color.NRGBA, bool, error) {
+	open, end := strings.Index(s, "("), strings.LastIndex(s, ")")
+	if end != len(s)-1 {
+		return color.NRGBA{}, false, fmt.Errorf("missing closing parenthesis")
+	}
+
+	args := strings.Split(s[open+1:end], ",")
+	if len(args) != 3 && len(args) != 4 {
+		return color.NRGBA{}, false, fmt.Errorf("expected 3 or 4 values, got %d", len(args))
+	}
+
+	var channels [3]uint8
+	for i := range channels {
+		v, err := parseColorValue(args[i], 255)
+		if err != nil {
+			return color.NRGBA{}, false, err
+		}
+		channels[i] = v
+	}
+
+	c := color.NRGBA{R: channels[0], G: channels[1], B: channels[2], A: 0xff}
+	if len(args) == 4 {
+		alpha, err := parseColorValue(args[3], 1)
+		if err != nil {
+			return color.NRGBA{}, false, err
+		}
+		c.A = alpha
+	}
+
+	return c, len(args) == 4, nil
+}
+
+// parseColorValue parses a channel given as a number up to max or a
+// percentage, and scales it to 0-255
+func parseColorValue(s string, max float64) (uint8, error) {
+	s = strings.TrimSpace(s)
+
+	scale := 255 / max
+	if strings.HasSuffix(s, "%") {
+		s = strings.TrimSuffix(s, "%")
+		max, scale = 100, 2.55
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	if v < 0 || v > max {
+		return 0, fmt.Errorf("value %s is out of range 0-%g", s, max)
+	}
+
+	return uint8(v*scale + 0.5), nil
+}
@@ -0,0 +1,64 @@
+package watermark
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DirConfigFile is the name of a file overriding the settings for the images
+// of its directory and its subdirectories, like an .editorconfig file
+const DirConfigFile = ".id-watermark.yaml"
+
+// DirConfigFunc creates the config for the images of a directory from the
+// directory config files that apply to it, outermost first. Settings of
+// nearer files take precedence.
+type DirConfigFunc func(files []string) (*Config, error)
+
+// dirSettings are the effective settings of a directory
+type dirSettings struct {
+	// files are the directory config files that apply, outermost first
+	files     []string
+	processor *Processor
+	err       error
+}
+
+// dirSettings returns the settings for the images of a directory below the
+// input directory, merging its directory config file over those of its
+// parents. Settings are cached, so every directory is only resolved once.
+func (bp *BatchProcessor) dirSettings(dir, inputDir string) *dirSettings {
+	dir = filepath.Clean(dir)
+	if settings, ok := bp.dirs[dir]; ok {
+		return settings
+	}
+
+	settings := &dirSettings{processor: bp.processor}
+	if parent := filepath.Dir(dir); dir != filepath.Clean(inputDir) && parent != dir {
+		*settings = *bp.dirSettings(parent, inputDir)
+	}
+
+	file := filepath.Join(dir, DirConfigFile)
+	if _, err := os.Stat(file); err == nil {
+		settings.files = append(settings.files[:len(settings.files):len(settings.files)], file)
+		settings.processor, settings.err = bp.dirProcessor(settings.files)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		settings.err = classify(ErrorClassConfig, fmt.Errorf("reading %s: %w", file, err))
+	}
+
+	bp.dirs[dir] = settings
+	return settings
+}
+
+// dirProcessor creates a processor from directory config files
+func (bp *BatchProcessor) dirProcessor(files []string) (*Processor, error) {
+	config, err := bp.dirConfig(files)
+	if err != nil {
+		return nil, classify(ErrorClassConfig, fmt.Errorf("applying %s: %w", files[len(files)-1], err))
+	}
+	if err := ValidateConfig(config); err != nil {
+		return nil, classify(ErrorClassConfig, fmt.Errorf("invalid config from %s: %w", files[len(files)-1], err))
+	}
+
+	return NewProcessor(config), nil
+}
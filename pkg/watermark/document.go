@@ -0,0 +1,509 @@
+package watermark
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+
+	"golang.org/x/image/draw"
+)
+
+// ErrNoDocument is returned when document detection cannot find a document outline
+var ErrNoDocument = errors.New("no document outline detected")
+
+const (
+	// detectionMaxSize is the longest side of the downscaled image used for edge detection
+	detectionMaxSize = 512
+	// minDocumentArea is the minimum fraction of the image a detected document must cover
+	minDocumentArea = 0.1
+	// maxDocumentArea is the maximum fraction of the image a detected document may cover,
+	// anything larger is most likely the image frame itself
+	maxDocumentArea = 0.98
+)
+
+// Quad is a quadrilateral in image coordinates, ordered top-left, top-right,
+// bottom-right, bottom-left
+type Quad [4]Point
+
+// Point is a point in image coordinates
+type Point struct {
+	X, Y float64
+}
+
+// detection is the outcome of document detection, with the edge map and the
+// largest contour that the debug outline shows when no document is found
+type detection struct {
+	quad Quad
+	// edges is the edge map, white on black, at the scale of the detection
+	edges *image.Gray
+	// hull is the convex hull of the largest contour in image coordinates,
+	// or nil when there is no contour
+	hull []Point
+}
+
+// DetectDocument finds the outline of the largest document in an image using
+// edge detection and contour analysis
+func DetectDocument(img image.Image) (Quad, error) {
+	d, err := detect(img)
+	return d.quad, err
+}
+
+// detect runs document detection, returning what was found even when no
+// document outline is detected
+func detect(img image.Image) (detection, error) {
+	bounds := img.Bounds()
+	scale := 1.0
+	if longest := max(bounds.Dx(), bounds.Dy()); longest > detectionMaxSize {
+		scale = float64(detectionMaxSize) / float64(longest)
+	}
+
+	w := max(1, int(float64(bounds.Dx())*scale))
+	h := max(1, int(float64(bounds.Dy())*scale))
+	gray := image.NewGray(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(gray, gray.Bounds(), img, bounds, draw.Src, nil)
+
+	edges := detectEdges(blurGray(gray))
+	d := detection{edges: image.NewGray(gray.Rect)}
+	for i, edge := range edges {
+		if edge {
+			d.edges.Pix[i] = 0xff
+		}
+	}
+
+	toImage := func(p Point) Point {
+		return Point{
+			X: float64(bounds.Min.X) + p.X/scale,
+			Y: float64(bounds.Min.Y) + p.Y/scale,
+		}
+	}
+
+	hull := largestContourHull(edges, w, h)
+	if hull == nil {
+		return d, ErrNoDocument
+	}
+	for _, p := range hull {
+		d.hull = append(d.hull, toImage(p))
+	}
+
+	area := polygonArea(hull)
+	if area < minDocumentArea*float64(w*h) || area > maxDocumentArea*float64(w*h) {
+		return d, ErrNoDocument
+	}
+
+	corners := quadCorners(hull)
+	if len(corners) != 4 {
+		return d, ErrNoDocument
+	}
+
+	for i, c := range orderCorners(corners) {
+		d.quad[i] = toImage(c)
+	}
+
+	return d, nil
+}
+
+// WarpDocument maps the quadrilateral onto an upright rectangle, preserving
+// the aspect ratio of the document as measured along its edges
+func WarpDocument(img image.Image, quad Quad) image.Image {
+	width := math.Max(distance(quad[0], quad[1]), distance(quad[3], quad[2]))
+	height := math.Max(distance(quad[0], quad[3]), distance(quad[1], quad[2]))
+	w, h := int(math.Round(width)), int(math.Round(height))
+
+	dst := Quad{{0, 0}, {float64(w), 0}, {float64(w), float64(h)}, {0, float64(h)}}
+	m := homography(dst, quad)
+
+	src := toRGBA(img)
+	result := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			u, v := float64(x)+0.5, float64(y)+0.5
+			d := m[6]*u + m[7]*v + 1
+			sx := (m[0]*u + m[1]*v + m[2]) / d
+			sy := (m[3]*u + m[4]*v + m[5]) / d
+			result.SetRGBA(x, y, sampleBilinear(src, sx-0.5, sy-0.5))
+		}
+	}
+
+	return result
+}
+
+// DrawOutline returns a copy of the image with the quadrilateral drawn on top of it
+func DrawOutline(img image.Image, quad Quad, c color.RGBA) image.Image {
+	result := toRGBA(img)
+	drawPolygon(result, quad[:], c)
+	return result
+}
+
+// drawFailedDetection shows why no document was found: the edge map at the
+// size of the image, with the largest contour drawn on top of it
+func drawFailedDetection(img image.Image, d detection, c color.RGBA) image.Image {
+	result := image.NewRGBA(img.Bounds())
+	if d.edges != nil {
+		draw.NearestNeighbor.Scale(result, result.Bounds(), d.edges, d.edges.Bounds(), draw.Src, nil)
+	}
+	drawPolygon(result, d.hull, c)
+	return result
+}
+
+// drawPolygon draws the edges of a polygon with lines proportional to the image size
+func drawPolygon(img *image.RGBA, polygon []Point, c color.RGBA) {
+	bounds := img.Bounds()
+	radius := math.Max(2, float64(min(bounds.Dx(), bounds.Dy()))/200)
+
+	for i := range polygon {
+		a, b := polygon[i], polygon[(i+1)%len(polygon)]
+		steps := int(math.Ceil(distance(a, b)))
+		for s := 0; s <= steps; s++ {
+			t := float64(s) / float64(max(steps, 1))
+			fillCircle(img, a.X+(b.X-a.X)*t, a.Y+(b.Y-a.Y)*t, radius, c)
+		}
+	}
+}
+
+// blurGray applies a 5x5 binomial blur to reduce noise before edge detection
+func blurGray(src *image.Gray) *image.Gray {
+	kernel := [5]int{1, 4, 6, 4, 1}
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	tmp := make([]int, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sum := 0
+			for k := -2; k <= 2; k++ {
+				sum += kernel[k+2] * int(src.Pix[y*src.Stride+clamp(x+k, 0, w-1)])
+			}
+			tmp[y*w+x] = sum
+		}
+	}
+
+	dst := image.NewGray(bounds)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sum := 0
+			for k := -2; k <= 2; k++ {
+				sum += kernel[k+2] * tmp[clamp(y+k, 0, h-1)*w+x]
+			}
+			dst.Pix[y*dst.Stride+x] = uint8(sum / 256)
+		}
+	}
+
+	return dst
+}
+
+// detectEdges computes the Sobel gradient magnitude and thresholds it with
+// Otsu's method, returning a binary edge map
+func detectEdges(src *image.Gray) []bool {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	at := func(x, y int) int {
+		return int(src.Pix[clamp(y, 0, h-1)*src.Stride+clamp(x, 0, w-1)])
+	}
+
+	magnitude := make([]float64, w*h)
+	peak := 0.0
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			gx := -at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1) + at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1)
+			gy := -at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1) + at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1)
+			m := math.Hypot(float64(gx), float64(gy))
+			magnitude[y*w+x] = m
+			peak = math.Max(peak, m)
+		}
+	}
+
+	edges := make([]bool, w*h)
+	if peak == 0 {
+		return edges
+	}
+
+	var histogram [256]int
+	for _, m := range magnitude {
+		histogram[int(m/peak*255)]++
+	}
+	threshold := otsuThreshold(histogram, len(magnitude))
+
+	for i, m := range magnitude {
+		edges[i] = int(m/peak*255) > threshold
+	}
+
+	return edges
+}
+
+// otsuThreshold returns the histogram bin that maximizes between-class variance
+func otsuThreshold(histogram [256]int, total int) int {
+	sum := 0.0
+	for i, count := range histogram {
+		sum += float64(i * count)
+	}
+
+	var sumBackground, best float64
+	weightBackground, threshold := 0, 0
+	for i, count := range histogram {
+		weightBackground += count
+		if weightBackground == 0 {
+			continue
+		}
+		weightForeground := total - weightBackground
+		if weightForeground == 0 {
+			break
+		}
+
+		sumBackground += float64(i * count)
+		meanBackground := sumBackground / float64(weightBackground)
+		meanForeground := (sum - sumBackground) / float64(weightForeground)
+		variance := float64(weightBackground) * float64(weightForeground) * (meanBackground - meanForeground) * (meanBackground - meanForeground)
+		if variance > best {
+			best = variance
+			threshold = i
+		}
+	}
+
+	return threshold
+}
+
+// largestContourHull groups edge pixels into 8-connected contours and returns
+// the convex hull with the largest area
+func largestContourHull(edges []bool, w, h int) []Point {
+	visited := make([]bool, len(edges))
+	var best []Point
+	bestArea := 0.0
+
+	for start := range edges {
+		if !edges[start] || visited[start] {
+			continue
+		}
+
+		var contour []Point
+		stack := []int{start}
+		visited[start] = true
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			x, y := i%w, i/w
+			contour = append(contour, Point{X: float64(x), Y: float64(y)})
+
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					nx, ny := x+dx, y+dy
+					if nx < 0 || ny < 0 || nx >= w || ny >= h {
+						continue
+					}
+					n := ny*w + nx
+					if edges[n] && !visited[n] {
+						visited[n] = true
+						stack = append(stack, n)
+					}
+				}
+			}
+		}
+
+		if len(contour) < 3 {
+			continue
+		}
+		hull := convexHull(contour)
+		if area := polygonArea(hull); area > bestArea {
+			best, bestArea = hull, area
+		}
+	}
+
+	return best
+}
+
+// convexHull computes the convex hull of a set of points using the monotone chain algorithm
+func convexHull(points []Point) []Point {
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].X != points[j].X {
+			return points[i].X < points[j].X
+		}
+		return points[i].Y < points[j].Y
+	})
+
+	hull := make([]Point, 0, 2*len(points))
+	for pass := 0; pass < 2; pass++ {
+		start := len(hull)
+		for _, p := range points {
+			for len(hull) >= start+2 && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+				hull = hull[:len(hull)-1]
+			}
+			hull = append(hull, p)
+		}
+		hull = hull[:len(hull)-1]
+
+		for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+			points[i], points[j] = points[j], points[i]
+		}
+	}
+
+	return hull
+}
+
+// quadCorners picks the four hull points that best describe a quadrilateral:
+// the two points furthest apart form one diagonal, and the points furthest
+// from that diagonal on either side form the other
+func quadCorners(hull []Point) []Point {
+	if len(hull) < 4 {
+		return nil
+	}
+
+	a, c, longest := 0, 0, 0.0
+	for i := range hull {
+		for j := i + 1; j < len(hull); j++ {
+			if d := distance(hull[i], hull[j]); d > longest {
+				a, c, longest = i, j, d
+			}
+		}
+	}
+
+	b, d := -1, -1
+	var left, right float64
+	for i, p := range hull {
+		side := cross(hull[a], hull[c], p)
+		if side > left {
+			b, left = i, side
+		} else if -side > right {
+			d, right = i, -side
+		}
+	}
+	if b < 0 || d < 0 {
+		return nil
+	}
+
+	return []Point{hull[a], hull[b], hull[c], hull[d]}
+}
+
+// orderCorners orders four corners clockwise starting from the top-left one
+func orderCorners(corners []Point) []Point {
+	var cx, cy float64
+	for _, c := range corners {
+		cx += c.X / float64(len(corners))
+		cy += c.Y / float64(len(corners))
+	}
+
+	ordered := append([]Point(nil), corners...)
+	sort.Slice(ordered, func(i, j int) bool {
+		return math.Atan2(ordered[i].Y-cy, ordered[i].X-cx) < math.Atan2(ordered[j].Y-cy, ordered[j].X-cx)
+	})
+
+	first := 0
+	for i, c := range ordered {
+		if c.X+c.Y < ordered[first].X+ordered[first].Y {
+			first = i
+		}
+	}
+
+	return append(ordered[first:], ordered[:first]...)
+}
+
+// homography computes the projective transform mapping the from quad onto the to quad
+func homography(from, to Quad) [8]float64 {
+	var a [8][9]float64
+	for i := 0; i < 4; i++ {
+		u, v := from[i].X, from[i].Y
+		x, y := to[i].X, to[i].Y
+		a[2*i] = [9]float64{u, v, 1, 0, 0, 0, -u * x, -v * x, x}
+		a[2*i+1] = [9]float64{0, 0, 0, u, v, 1, -u * y, -v * y, y}
+	}
+
+	// Gaussian elimination with partial pivoting
+	for col := 0; col < 8; col++ {
+		pivot := col
+		for row := col + 1; row < 8; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+
+		for row := 0; row < 8; row++ {
+			if row == col || a[col][col] == 0 {
+				continue
+			}
+			f := a[row][col] / a[col][col]
+			for k := col; k < 9; k++ {
+				a[row][k] -= f * a[col][k]
+			}
+		}
+	}
+
+	var m [8]float64
+	for i := range m {
+		if a[i][i] != 0 {
+			m[i] = a[i][8] / a[i][i]
+		}
+	}
+	return m
+}
+
+// sampleBilinear samples an image at fractional coordinates
+func sampleBilinear(img *image.RGBA, x, y float64) color.RGBA {
+	bounds := img.Bounds()
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	fx, fy := x-float64(x0), y-float64(y0)
+
+	at := func(px, py int) color.RGBA {
+		return img.RGBAAt(clamp(px, bounds.Min.X, bounds.Max.X-1), clamp(py, bounds.Min.Y, bounds.Max.Y-1))
+	}
+	c00, c10 := at(x0, y0), at(x0+1, y0)
+	c01, c11 := at(x0, y0+1), at(x0+1, y0+1)
+
+	mix := func(a, b, c, d uint8) uint8 {
+		top := float64(a)*(1-fx) + float64(b)*fx
+		bottom := float64(c)*(1-fx) + float64(d)*fx
+		return uint8(math.Round(top*(1-fy) + bottom*fy))
+	}
+
+	return color.RGBA{
+		R: mix(c00.R, c10.R, c01.R, c11.R),
+		G: mix(c00.G, c10.G, c01.G, c11.G),
+		B: mix(c00.B, c10.B, c01.B, c11.B),
+		A: mix(c00.A, c10.A, c01.A, c11.A),
+	}
+}
+
+// fillCircle fills a circle of the given radius centered on (cx, cy)
+func fillCircle(img *image.RGBA, cx, cy, radius float64, c color.RGBA) {
+	for y := int(cy - radius); y <= int(cy+radius); y++ {
+		for x := int(cx - radius); x <= int(cx+radius); x++ {
+			if (float64(x)-cx)*(float64(x)-cx)+(float64(y)-cy)*(float64(y)-cy) <= radius*radius {
+				if (image.Point{X: x, Y: y}).In(img.Bounds()) {
+					img.SetRGBA(x, y, c)
+				}
+			}
+		}
+	}
+}
+
+// toRGBA returns a copy of the image as *image.RGBA
+func toRGBA(img image.Image) *image.RGBA {
+	result := image.NewRGBA(img.Bounds())
+	draw.Draw(result, result.Bounds(), img, img.Bounds().Min, draw.Src)
+	return result
+}
+
+// polygonArea returns the area of a simple polygon using the shoelace formula
+func polygonArea(polygon []Point) float64 {
+	area := 0.0
+	for i := range polygon {
+		j := (i + 1) % len(polygon)
+		area += polygon[i].X*polygon[j].Y - polygon[j].X*polygon[i].Y
+	}
+	return math.Abs(area) / 2
+}
+
+// cross returns the z component of the cross product of (b - a) and (c - a)
+func cross(a, b, c Point) float64 {
+	return (b.X-a.X)*(c.Y-a.Y) - (b.Y-a.Y)*(c.X-a.X)
+}
+
+// distance returns the Euclidean distance between two points
+func distance(a, b Point) float64 {
+	return math.Hypot(b.X-a.X, b.Y-a.Y)
+}
+
+// clamp limits v to the range [lo, hi]
+func clamp(v, lo, hi int) int {
+	return max(lo, min(v, hi))
+}
@@ -0,0 +1,143 @@
+package watermark
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// syntheticDocument draws a light convex quadrilateral on a dark background,
+// with a red patch in the corner of the document nearest quad[0]
+func syntheticDocument(w, h int, quad Quad) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	marker := Point{X: quad[0].X + (quad[2].X-quad[0].X)*0.15, Y: quad[0].Y + (quad[2].Y-quad[0].Y)*0.15}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := Point{X: float64(x) + 0.5, Y: float64(y) + 0.5}
+			c := color.RGBA{R: 30, G: 30, B: 40, A: 255}
+			if insideQuad(quad, p) {
+				c = color.RGBA{R: 235, G: 235, B: 225, A: 255}
+				if distance(p, marker) < 12 {
+					c = color.RGBA{R: 220, A: 255}
+				}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// uniformImage returns an image of a single color
+func uniformImage(w, h int, c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+// insideQuad reports whether a point is inside a clockwise convex quadrilateral
+func insideQuad(quad Quad, p Point) bool {
+	for i := range quad {
+		if cross(quad[i], quad[(i+1)%4], p) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDetectDocument(t *testing.T) {
+	tests := []struct {
+		name string
+		w, h int
+		quad Quad
+	}{
+		{"upright", 400, 300, Quad{{60, 50}, {340, 50}, {340, 250}, {60, 250}}},
+		{"rotated", 400, 300, Quad{{110, 40}, {350, 90}, {300, 270}, {60, 215}}},
+		{"perspective", 400, 300, Quad{{90, 40}, {320, 60}, {370, 260}, {40, 240}}},
+		// Larger than the detection size, so corners are scaled back
+		{"downscaled", 1200, 900, Quad{{200, 150}, {1000, 120}, {1050, 780}, {160, 800}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := syntheticDocument(tt.w, tt.h, tt.quad)
+			quad, err := DetectDocument(img)
+			if err != nil {
+				t.Fatalf("DetectDocument() failed: %v", err)
+			}
+
+			// Edges are found a pixel or two off at the detection scale
+			tolerance := 4 * math.Max(1, float64(max(tt.w, tt.h))/detectionMaxSize)
+			for i := range quad {
+				if d := distance(quad[i], tt.quad[i]); d > tolerance {
+					t.Errorf("corner %d = %v, want %v (off by %.1f)", i, quad[i], tt.quad[i], d)
+				}
+			}
+		})
+	}
+}
+
+func TestDetectDocumentNotFound(t *testing.T) {
+	tests := []struct {
+		name string
+		img  image.Image
+	}{
+		{"uniform", uniformImage(200, 100, color.RGBA{R: 128, G: 128, B: 128, A: 255})},
+		{"small document", syntheticDocument(400, 300, Quad{{180, 130}, {220, 130}, {220, 160}, {180, 160}})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DetectDocument(tt.img); !errors.Is(err, ErrNoDocument) {
+				t.Errorf("DetectDocument() error = %v, want %v", err, ErrNoDocument)
+			}
+		})
+	}
+}
+
+func TestWarpDocument(t *testing.T) {
+	quad := Quad{{110, 40}, {350, 90}, {300, 270}, {60, 215}}
+	img := syntheticDocument(400, 300, quad)
+
+	warped := WarpDocument(img, quad)
+	bounds := warped.Bounds()
+	wantW := math.Max(distance(quad[0], quad[1]), distance(quad[3], quad[2]))
+	wantH := math.Max(distance(quad[0], quad[3]), distance(quad[1], quad[2]))
+	if math.Abs(float64(bounds.Dx())-wantW) > 1 || math.Abs(float64(bounds.Dy())-wantH) > 1 {
+		t.Fatalf("warped size = %v, want %.0fx%.0f", bounds.Size(), wantW, wantH)
+	}
+
+	// The document fills the result, with the marker in the top-left corner
+	at := func(fx, fy float64) color.RGBA {
+		return color.RGBAModel.Convert(warped.At(int(fx*float64(bounds.Dx())), int(fy*float64(bounds.Dy())))).(color.RGBA)
+	}
+	for _, p := range [][2]float64{{0.5, 0.5}, {0.85, 0.15}, {0.85, 0.85}, {0.15, 0.85}} {
+		if c := at(p[0], p[1]); c.G < 200 {
+			t.Errorf("pixel at %v = %v, want the light document", p, c)
+		}
+	}
+	if c := at(0.15, 0.15); c.R < 200 || c.G > 60 {
+		t.Errorf("pixel at the top-left = %v, want the red marker", c)
+	}
+}
+
+func TestPrepareImageWithoutDocument(t *testing.T) {
+	img := uniformImage(200, 100, color.RGBA{R: 200, G: 200, B: 200, A: 255})
+
+	output := filepath.Join(t.TempDir(), "plain.png")
+	p := NewProcessor(&Config{DetectDocument: true, DebugOutline: true})
+	prepared, _, err := p.prepareImage(img, 0, output)
+	if err != nil {
+		t.Fatalf("prepareImage() failed: %v", err)
+	}
+	if prepared.Bounds() != img.Bounds() {
+		t.Errorf("prepared bounds = %v, want the uncropped %v", prepared.Bounds(), img.Bounds())
+	}
+	if _, err := os.Stat(debugOutlinePath(output)); err != nil {
+		t.Errorf("debug outline of the failed detection: %v", err)
+	}
+}
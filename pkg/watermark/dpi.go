@@ -0,0 +1,82 @@
+package watermark
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// readDPI extracts the horizontal resolution stored in JPEG (JFIF) or PNG
+// (pHYs) metadata. It returns 0 when the resolution is unknown.
+func readDPI(data []byte) float64 {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return readJFIFDPI(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return readPNGDPI(data)
+	default:
+		return 0
+	}
+}
+
+// readJFIFDPI reads the density from the JFIF APP0 segment
+func readJFIFDPI(data []byte) float64 {
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 0
+		}
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		// The length includes its own two bytes, so anything shorter is corrupt
+		if length < 2 {
+			return 0
+		}
+		segment := data[i+4 : min(len(data), i+2+length)]
+
+		// Start of scan, no more metadata segments follow
+		if marker == 0xDA {
+			return 0
+		}
+
+		if marker == 0xE0 && len(segment) >= 12 && bytes.HasPrefix(segment, []byte("JFIF\x00")) {
+			units := segment[7]
+			density := float64(binary.BigEndian.Uint16(segment[8:]))
+			switch units {
+			case 1:
+				return density
+			case 2:
+				return density * 2.54
+			default:
+				return 0
+			}
+		}
+
+		i += 2 + length
+	}
+
+	return 0
+}
+
+// readPNGDPI reads the density from the pHYs chunk
+func readPNGDPI(data []byte) float64 {
+	for i := 8; i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		chunkType := string(data[i+4 : i+8])
+		if chunkType == "IDAT" || chunkType == "IEND" || i+8+length > len(data) {
+			return 0
+		}
+
+		if chunkType == "pHYs" && length == 9 {
+			chunk := data[i+8 : i+8+length]
+			// Unit 1 is pixels per metre, anything else only gives an aspect ratio
+			if chunk[8] != 1 {
+				return 0
+			}
+			return float64(binary.BigEndian.Uint32(chunk)) * 0.0254
+		}
+
+		// Length, type, data and CRC
+		i += 12 + length
+	}
+
+	return 0
+}
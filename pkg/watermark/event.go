@@ -0,0 +1,65 @@
+package watermark
+
+import (
+	"os"
+	"time"
+)
+
+// EventType is the kind of a batch event
+type EventType string
+
+const (
+	// EventStarted is sent when a worker starts processing a file
+	EventStarted EventType = "started"
+	// EventFinished is sent when a file was processed successfully
+	EventFinished EventType = "finished"
+	// EventFailed is sent when a file could not be processed
+	EventFailed EventType = "failed"
+	// EventSkipped is sent when a file is unchanged since it was last processed
+	EventSkipped EventType = "skipped"
+	// EventCanceled is sent when the batch is cancelled while a file is processed
+	EventCanceled EventType = "canceled"
+)
+
+// Event reports the progress of a single file of a batch
+type Event struct {
+	Type       EventType
+	Time       time.Time
+	InputPath  string
+	OutputPath string
+	// Total is the number of files in the batch
+	Total int
+
+	// Duration, InputBytes, OutputBytes and Err are set once the file is done
+	Duration    time.Duration
+	InputBytes  int64
+	OutputBytes int64
+	Err         error
+}
+
+// EventFunc receives batch events. Calls are serialized, so it does not
+// need to be safe for concurrent use, but it should return quickly as
+// workers wait for it.
+type EventFunc func(Event)
+
+// emit sends an event to the event function, if any
+func (bp *BatchProcessor) emit(event Event) {
+	if bp.onEvent == nil {
+		return
+	}
+
+	bp.eventMu.Lock()
+	defer bp.eventMu.Unlock()
+
+	event.Time = time.Now()
+	bp.onEvent(event)
+}
+
+// fileSize returns the size of a file, or zero if it cannot be read
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
@@ -1,15 +1,21 @@
 package watermark
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
 )
 
 // FontManager handles font loading and management
 type FontManager struct {
 	systemFontPaths []string
+	fontDirs        []string
+	index           []FontInfo
 }
 
 // NewFontManager creates a new font manager with default system font paths
@@ -25,6 +31,7 @@ func NewFontManager() *FontManager {
 			"/usr/share/fonts/TTF/arial.ttf",
 			"/usr/share/fonts/TTF/DejaVuSans.ttf",
 		},
+		fontDirs: DefaultFontDirs(),
 	}
 }
 
@@ -33,42 +40,161 @@ func (fm *FontManager) SetSystemFontPaths(paths []string) {
 	fm.systemFontPaths = paths
 }
 
-// LoadFont loads a font from the specified path, with fallback to system fonts
+// LoadFont loads the font given as a builtin name, a file path or a
+// "Family[:style]" name, see LoadFontSpec. A font that cannot be loaded is an
+// error, so a typo does not silently draw another font. When no font is
+// given, the first system font found is used, and finally the embedded
+// default font.
 func (fm *FontManager) LoadFont(fontPath string) (*opentype.Font, error) {
-	// Try to load the specified font first
 	if fontPath != "" {
-		if font, err := fm.loadFontFromPath(fontPath); err == nil {
-			return font, nil
-		}
+		return fm.LoadFontSpec(fontPath)
 	}
 
 	// Fallback to system fonts
 	for _, path := range fm.systemFontPaths {
-		if fm.fileExists(path) {
+		if file, _ := fm.splitFontPath(path); fm.fileExists(file) {
 			if font, err := fm.loadFontFromPath(path); err == nil {
 				return font, nil
 			}
 		}
 	}
 
-	return nil, fmt.Errorf("no suitable font found. Tried: %s and system fonts", fontPath)
+	// Fallback to the embedded font
+	font, err := loadBuiltinFont(DefaultBuiltinFont)
+	if err != nil {
+		return nil, fmt.Errorf("no suitable font found. Tried system fonts and builtin font: %w", err)
+	}
+
+	return font, nil
+}
+
+// LoadFallbackFonts loads the fonts of a fallback chain, given as paths,
+// family names or builtin names. Fonts that cannot be found are skipped,
+// since fallback lists usually name fonts only installed on some machines.
+func (fm *FontManager) LoadFallbackFonts(specs []string) []*opentype.Font {
+	fonts := make([]*opentype.Font, 0, len(specs))
+	for _, spec := range specs {
+		if font, err := fm.LoadFontSpec(spec); err == nil {
+			fonts = append(fonts, font)
+		}
+	}
+	return fonts
+}
+
+// LoadFontSpec loads a font given as a builtin name, a file path or a
+// "Family[:style]" name, without falling back to other fonts
+func (fm *FontManager) LoadFontSpec(spec string) (*opentype.Font, error) {
+	if IsBuiltinFont(spec) {
+		return loadBuiltinFont(strings.TrimPrefix(spec, BuiltinPrefix))
+	}
+
+	font, err := fm.loadFontFromPath(spec)
+	if err == nil {
+		return font, nil
+	}
+
+	// Anything that looks like a path is not looked up as a family name
+	if file, _ := fm.splitFontPath(spec); fm.fileExists(file) || strings.ContainsAny(spec, `/\`) || isFontFile(file) {
+		return nil, err
+	}
+
+	info, findErr := fm.FindFont(spec)
+	if findErr != nil {
+		return nil, findErr
+	}
+	return fm.loadFontFromPath(info.Path)
 }
 
-// loadFontFromPath loads a font from a specific file path
+// loadFontFromPath loads a font from a specific file path. Faces inside
+// TrueType/OpenType collections are selected with a "#index" or "#name"
+// suffix, and the first face is used when none is given.
 func (fm *FontManager) loadFontFromPath(path string) (*opentype.Font, error) {
-	fontData, err := os.ReadFile(path)
+	file, face := fm.splitFontPath(path)
+
+	fontData, err := os.ReadFile(file)
 	if err != nil {
-		return nil, fmt.Errorf("reading font file %s: %w", path, err)
+		return nil, fmt.Errorf("reading font file %s: %w", file, err)
+	}
+
+	if isCollection(fontData) {
+		return loadCollectionFace(fontData, file, face)
+	}
+
+	if face != "" && face != "0" {
+		return nil, fmt.Errorf("font file %s is not a collection, cannot select face %q", file, face)
 	}
 
 	font, err := opentype.Parse(fontData)
 	if err != nil {
-		return nil, fmt.Errorf("parsing font file %s: %w", path, err)
+		return nil, fmt.Errorf("parsing font file %s: %w", file, err)
 	}
 
 	return font, nil
 }
 
+// splitFontPath splits a "path#face" specification into the file path and
+// the face selector. Existing files are never split, so file names that
+// contain '#' keep working.
+func (fm *FontManager) splitFontPath(path string) (string, string) {
+	if fm.fileExists(path) {
+		return path, ""
+	}
+	if i := strings.LastIndex(path, "#"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+// isCollection reports whether the font data is a TrueType/OpenType collection
+func isCollection(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("ttcf"))
+}
+
+// loadCollectionFace selects a face from a collection by index or by name.
+// Names are matched against the full, PostScript and family names.
+func loadCollectionFace(data []byte, file, face string) (*opentype.Font, error) {
+	collection, err := opentype.ParseCollection(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing font collection %s: %w", file, err)
+	}
+
+	if face == "" {
+		face = "0"
+	}
+
+	if index, err := strconv.Atoi(face); err == nil {
+		if index < 0 || index >= collection.NumFonts() {
+			return nil, fmt.Errorf("font collection %s has %d faces, cannot select face %d", file, collection.NumFonts(), index)
+		}
+		font, err := collection.Font(index)
+		if err != nil {
+			return nil, fmt.Errorf("parsing face %d of font collection %s: %w", index, file, err)
+		}
+		return font, nil
+	}
+
+	var buf sfnt.Buffer
+	var available []string
+	for i := 0; i < collection.NumFonts(); i++ {
+		font, err := collection.Font(i)
+		if err != nil {
+			continue
+		}
+
+		full, _ := font.Name(&buf, sfnt.NameIDFull)
+		postScript, _ := font.Name(&buf, sfnt.NameIDPostScript)
+		family, _ := font.Name(&buf, sfnt.NameIDFamily)
+		for _, name := range []string{full, postScript, family} {
+			if name != "" && strings.EqualFold(name, face) {
+				return font, nil
+			}
+		}
+		available = append(available, fmt.Sprintf("%d: %s", i, full))
+	}
+
+	return nil, fmt.Errorf("no face named %q in font collection %s (available: %s)", face, file, strings.Join(available, ", "))
+}
+
 // fileExists checks if a file exists
 func (fm *FontManager) fileExists(path string) bool {
 	_, err := os.Stat(path)
@@ -79,7 +205,7 @@ func (fm *FontManager) fileExists(path string) bool {
 func (fm *FontManager) GetAvailableSystemFonts() []string {
 	var available []string
 	for _, path := range fm.systemFontPaths {
-		if fm.fileExists(path) {
+		if file, _ := fm.splitFontPath(path); fm.fileExists(file) {
 			available = append(available, path)
 		}
 	}
@@ -0,0 +1,86 @@
+package watermark
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testFontManager returns a font manager whose only font directory holds
+// the embedded Liberation Sans regular and bold, and no system fonts
+func testFontManager(t *testing.T) (*FontManager, string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, file := range map[string]string{"sans": "LiberationSans-Regular.ttf", "sans-bold": "LiberationSans-Bold.ttf"} {
+		if err := os.WriteFile(filepath.Join(dir, file), builtinFonts[name], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fm := NewFontManager()
+	fm.SetSystemFontPaths(nil)
+	fm.SetFontDirs([]string{dir})
+	return fm, dir
+}
+
+func TestLoadFont(t *testing.T) {
+	fm, dir := testFontManager(t)
+
+	tests := []struct {
+		name    string
+		spec    string
+		wantErr bool
+	}{
+		{name: "default falls back", spec: ""},
+		{name: "builtin", spec: "builtin:serif"},
+		{name: "path", spec: filepath.Join(dir, "LiberationSans-Bold.ttf")},
+		{name: "family", spec: "Liberation Sans"},
+		{name: "family and style", spec: "liberation sans:bold"},
+		{name: "unknown builtin", spec: "builtin:fancy", wantErr: true},
+		{name: "missing path", spec: filepath.Join(dir, "missing.ttf"), wantErr: true},
+		{name: "missing relative file", spec: "missing.otf", wantErr: true},
+		{name: "unknown family", spec: "Liberation Sanz:bold", wantErr: true},
+		{name: "missing style", spec: "Liberation Sans:black", wantErr: true},
+		{name: "missing slant", spec: "Liberation Sans:bold italic", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			font, err := fm.LoadFont(tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("LoadFont(%q) succeeded, want an error", tt.spec)
+				}
+				return
+			}
+			if err != nil || font == nil {
+				t.Errorf("LoadFont(%q) failed: %v", tt.spec, err)
+			}
+		})
+	}
+}
+
+func TestFindFont(t *testing.T) {
+	fm, dir := testFontManager(t)
+
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"Liberation Sans", "LiberationSans-Regular.ttf"},
+		{"Liberation Sans:regular", "LiberationSans-Regular.ttf"},
+		{"Liberation Sans:bold", "LiberationSans-Bold.ttf"},
+		{"Liberation Sans:700", "LiberationSans-Bold.ttf"},
+	}
+
+	for _, tt := range tests {
+		info, err := fm.FindFont(tt.spec)
+		if err != nil {
+			t.Errorf("FindFont(%q) failed: %v", tt.spec, err)
+			continue
+		}
+		if info.Path != filepath.Join(dir, tt.want) {
+			t.Errorf("FindFont(%q) = %s, want %s", tt.spec, info.Path, tt.want)
+		}
+	}
+}
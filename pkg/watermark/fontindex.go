@@ -0,0 +1,269 @@
+package watermark
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+)
+
+// FontInfo describes a font face found while scanning font directories
+type FontInfo struct {
+	Path   string
+	Family string
+	Style  string
+	Weight int
+	Italic bool
+}
+
+// weightNames maps style keywords to CSS/OpenType weight classes
+var weightNames = []struct {
+	name   string
+	weight int
+}{
+	// Longer names first so "extrabold" is not matched as "bold"
+	{"extralight", 200},
+	{"ultralight", 200},
+	{"extrabold", 800},
+	{"ultrabold", 800},
+	{"semibold", 600},
+	{"demibold", 600},
+	{"hairline", 100},
+	{"regular", 400},
+	{"medium", 500},
+	{"normal", 400},
+	{"light", 300},
+	{"heavy", 900},
+	{"black", 900},
+	{"thin", 100},
+	{"bold", 700},
+	{"book", 400},
+}
+
+// DefaultFontDirs returns the standard font directories for the current
+// platform, including the XDG user font directory
+func DefaultFontDirs() []string {
+	home, _ := os.UserHomeDir()
+
+	switch runtime.GOOS {
+	case "darwin":
+		return []string{
+			"/System/Library/Fonts",
+			"/Library/Fonts",
+			filepath.Join(home, "Library", "Fonts"),
+		}
+	case "windows":
+		dirs := []string{filepath.Join(os.Getenv("WINDIR"), "Fonts")}
+		if local := os.Getenv("LOCALAPPDATA"); local != "" {
+			dirs = append(dirs, filepath.Join(local, "Microsoft", "Windows", "Fonts"))
+		}
+		return dirs
+	default:
+		dataHome := os.Getenv("XDG_DATA_HOME")
+		if dataHome == "" {
+			dataHome = filepath.Join(home, ".local", "share")
+		}
+		return []string{
+			"/usr/share/fonts",
+			"/usr/local/share/fonts",
+			filepath.Join(dataHome, "fonts"),
+			filepath.Join(home, ".fonts"),
+		}
+	}
+}
+
+// SetFontDirs sets the directories scanned when resolving fonts by family name
+func (fm *FontManager) SetFontDirs(dirs []string) {
+	fm.fontDirs = dirs
+	fm.index = nil
+}
+
+// ScanFonts indexes every font found in the font directories. The index is
+// built once and reused by later lookups.
+func (fm *FontManager) ScanFonts() []FontInfo {
+	if fm.index != nil {
+		return fm.index
+	}
+
+	seen := make(map[string]bool)
+	index := make([]FontInfo, 0)
+	for _, dir := range fm.fontDirs {
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || seen[path] || !isFontFile(path) {
+				return nil
+			}
+			seen[path] = true
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil
+			}
+
+			// Index every face of a collection as "path#index"
+			if isCollection(data) {
+				collection, err := opentype.ParseCollection(data)
+				if err != nil {
+					return nil
+				}
+				for i := 0; i < collection.NumFonts(); i++ {
+					if font, err := collection.Font(i); err == nil {
+						index = append(index, DescribeFont(font, fmt.Sprintf("%s#%d", path, i)))
+					}
+				}
+				return nil
+			}
+
+			font, err := opentype.Parse(data)
+			if err != nil {
+				return nil
+			}
+			index = append(index, DescribeFont(font, path))
+			return nil
+		})
+	}
+
+	sort.Slice(index, func(i, j int) bool {
+		if index[i].Family != index[j].Family {
+			return index[i].Family < index[j].Family
+		}
+		if index[i].Weight != index[j].Weight {
+			return index[i].Weight < index[j].Weight
+		}
+		return index[i].Style < index[j].Style
+	})
+
+	fm.index = index
+	return index
+}
+
+// FindFont resolves a font specification of the form "Family[:style]", such
+// as "DejaVu Sans:bold", to an indexed font. The style may name a weight,
+// "italic", a combination like "bold italic", or a numeric weight, and the
+// family must have a face of that weight and slant. Without a style, the
+// face closest to regular is used.
+func (fm *FontManager) FindFont(spec string) (FontInfo, error) {
+	family, style, _ := strings.Cut(spec, ":")
+	family = strings.TrimSpace(family)
+	wantWeight, wantItalic := parseStyle(style)
+
+	var best FontInfo
+	var styles []string
+	bestScore := -1
+	for _, info := range fm.ScanFonts() {
+		if !strings.EqualFold(info.Family, family) {
+			continue
+		}
+		styles = append(styles, info.Style)
+
+		// Prefer matching slant, then the closest weight
+		score := 10000 - abs(info.Weight-wantWeight)
+		if info.Italic == wantItalic {
+			score += 10000
+		}
+		if score > bestScore {
+			best, bestScore = info, score
+		}
+	}
+
+	if bestScore < 0 {
+		return FontInfo{}, fmt.Errorf("no font found for family %q (see fonts list)", family)
+	}
+	if strings.TrimSpace(style) != "" && (best.Weight != wantWeight || best.Italic != wantItalic) {
+		return FontInfo{}, fmt.Errorf("font family %q has no %s style (available: %s)", family, strings.TrimSpace(style), strings.Join(styles, ", "))
+	}
+
+	return best, nil
+}
+
+// DescribeFont reads the family and style of a font from its name table
+func DescribeFont(font *opentype.Font, path string) FontInfo {
+	var buf sfnt.Buffer
+
+	family, err := font.Name(&buf, sfnt.NameIDTypographicFamily)
+	if err != nil || family == "" {
+		family, _ = font.Name(&buf, sfnt.NameIDFamily)
+	}
+	style, err := font.Name(&buf, sfnt.NameIDTypographicSubfamily)
+	if err != nil || style == "" {
+		style, _ = font.Name(&buf, sfnt.NameIDSubfamily)
+	}
+
+	if family == "" {
+		family = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if style == "" {
+		style = "Regular"
+	}
+
+	weight, italic := parseStyle(style)
+	return FontInfo{
+		Path:   path,
+		Family: family,
+		Style:  style,
+		Weight: weight,
+		Italic: italic,
+	}
+}
+
+// parseStyle derives the weight and slant from a style name
+func parseStyle(style string) (int, bool) {
+	normalized := strings.ToLower(strings.NewReplacer(" ", "", "-", "", "_", "").Replace(style))
+	italic := strings.Contains(normalized, "italic") || strings.Contains(normalized, "oblique")
+
+	if weight, err := strconv.Atoi(strings.TrimSpace(style)); err == nil {
+		return weight, false
+	}
+
+	for _, w := range weightNames {
+		if strings.Contains(normalized, w.name) {
+			return w.weight, italic
+		}
+	}
+
+	return 400, italic
+}
+
+// MissingRunes returns the runes of text, other than whitespace, that the font has no glyph for
+func MissingRunes(font *opentype.Font, text string) []rune {
+	var buf sfnt.Buffer
+	var missing []rune
+	seen := make(map[rune]bool)
+
+	for _, r := range text {
+		if seen[r] || strings.ContainsRune(" \t\n", r) {
+			continue
+		}
+		seen[r] = true
+
+		if index, err := font.GlyphIndex(&buf, r); err != nil || index == 0 {
+			missing = append(missing, r)
+		}
+	}
+
+	return missing
+}
+
+// isFontFile reports whether the path has a font file extension
+func isFontFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ttf", ".otf", ".ttc", ".otc":
+		return true
+	default:
+		return false
+	}
+}
+
+// abs returns the absolute value of an integer
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
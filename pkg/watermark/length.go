@@ -0,0 +1,110 @@
+package watermark
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/vgimg"
+)
+
+// Unit is the unit of a Length
+type Unit string
+
+const (
+	// UnitPoints is an absolute size in points
+	UnitPoints Unit = "pt"
+	// UnitPercentDiagonal is a percentage of the image diagonal
+	UnitPercentDiagonal Unit = "%"
+	// UnitPercentWidth is a percentage of the image width
+	UnitPercentWidth Unit = "%w"
+	// UnitMillimetres is a physical size, which requires the image DPI
+	UnitMillimetres Unit = "mm"
+)
+
+// Length is a size that is either absolute or relative to the image it is
+// drawn on, and is resolved separately for every image
+type Length struct {
+	Value float64
+	Unit  Unit
+}
+
+// Points returns an absolute length in points
+func Points(v float64) Length {
+	return Length{Value: v, Unit: UnitPoints}
+}
+
+// ParseLength parses a length such as "40", "40pt", "2.5%", "3%w" or "5mm".
+// Plain numbers are in points.
+func ParseLength(s string) (Length, error) {
+	input := s
+	s = strings.TrimSpace(s)
+
+	unit := UnitPoints
+	for _, u := range []Unit{UnitPercentWidth, UnitPercentDiagonal, UnitMillimetres, UnitPoints} {
+		if strings.HasSuffix(s, string(u)) {
+			unit = u
+			s = strings.TrimSpace(strings.TrimSuffix(s, string(u)))
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return Length{}, fmt.Errorf("invalid length %q (expected e.g. 40, 40pt, 2.5%%, 3%%w or 5mm)", input)
+	}
+
+	return Length{Value: value, Unit: unit}, nil
+}
+
+// String formats the length in the form accepted by ParseLength
+func (l Length) String() string {
+	return strconv.FormatFloat(l.Value, 'f', -1, 64) + string(l.Unit)
+}
+
+// Validate checks that the length is positive and, for points, within [lo, hi]
+func (l Length) Validate(name string, lo, hi float64) error {
+	switch l.Unit {
+	case UnitPoints:
+		if l.Value < lo || l.Value > hi {
+			return fmt.Errorf("%s must be between %g and %g, got: %.1f", name, lo, hi, l.Value)
+		}
+	case UnitPercentDiagonal, UnitPercentWidth:
+		if l.Value <= 0 || l.Value > 100 {
+			return fmt.Errorf("%s must be between 0%% and 100%%, got: %s", name, l)
+		}
+	case UnitMillimetres:
+		if l.Value <= 0 {
+			return fmt.Errorf("%s must be positive, got: %s", name, l)
+		}
+	default:
+		return fmt.Errorf("%s has unknown unit %q", name, l.Unit)
+	}
+	return nil
+}
+
+// resolve converts the length to canvas units for an image of the given
+// size and resolution. dpi is 0 when the resolution is unknown.
+func (l Length) resolve(size image.Point, dpi float64) (vg.Length, error) {
+	pixels := func(px float64) vg.Length {
+		return vg.Length(px) * vg.Inch / vgimg.DefaultDPI
+	}
+
+	switch l.Unit {
+	case UnitPercentDiagonal:
+		diagonal := math.Hypot(float64(size.X), float64(size.Y))
+		return pixels(diagonal * l.Value / 100), nil
+	case UnitPercentWidth:
+		return pixels(float64(size.X) * l.Value / 100), nil
+	case UnitMillimetres:
+		if dpi <= 0 {
+			return 0, fmt.Errorf("length %s requires the image DPI, which is unknown", l)
+		}
+		return pixels(l.Value / 25.4 * dpi), nil
+	default:
+		return vg.Length(l.Value), nil
+	}
+}
@@ -0,0 +1,122 @@
+package watermark
+
+import (
+	"image"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParseLength(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Length
+		wantErr bool
+	}{
+		{input: "40", want: Length{Value: 40, Unit: UnitPoints}},
+		{input: "40pt", want: Length{Value: 40, Unit: UnitPoints}},
+		{input: " 12.5 pt ", want: Length{Value: 12.5, Unit: UnitPoints}},
+		{input: "2.5%", want: Length{Value: 2.5, Unit: UnitPercentDiagonal}},
+		{input: "3%w", want: Length{Value: 3, Unit: UnitPercentWidth}},
+		{input: "5mm", want: Length{Value: 5, Unit: UnitMillimetres}},
+		{input: "-1", want: Length{Value: -1, Unit: UnitPoints}},
+		{input: "", wantErr: true},
+		{input: "pt", wantErr: true},
+		{input: "5cm", wantErr: true},
+		{input: "5%h", wantErr: true},
+		{input: "five", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseLength(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseLength(%q) = %v, want an error", tt.input, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseLength(%q) error = %v", tt.input, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseLength(%q) = %+v, want %+v", tt.input, got, tt.want)
+			}
+
+			// String gives back an equivalent length
+			if again, err := ParseLength(got.String()); err != nil || again != got {
+				t.Errorf("ParseLength(%q) = %+v, %v, want %+v", got.String(), again, err, got)
+			}
+		})
+	}
+}
+
+func TestLengthValidate(t *testing.T) {
+	tests := []struct {
+		length  Length
+		wantErr string
+	}{
+		{length: Points(10)},
+		{length: Points(200)},
+		{length: Points(9.9), wantErr: "between 10 and 200"},
+		{length: Points(201), wantErr: "between 10 and 200"},
+		{length: Length{Value: 0.1, Unit: UnitPercentDiagonal}},
+		{length: Length{Value: 100, Unit: UnitPercentWidth}},
+		{length: Length{Value: 0, Unit: UnitPercentDiagonal}, wantErr: "between 0% and 100%"},
+		{length: Length{Value: 100.5, Unit: UnitPercentWidth}, wantErr: "between 0% and 100%"},
+		// Physical sizes have no limits other than being positive
+		{length: Length{Value: 500, Unit: UnitMillimetres}},
+		{length: Length{Value: 0, Unit: UnitMillimetres}, wantErr: "must be positive"},
+		{length: Length{Value: 10, Unit: "cm"}, wantErr: "unknown unit"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.length.String(), func(t *testing.T) {
+			err := tt.length.Validate("font size", 10, 200)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Validate() error = %v, want none", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLengthResolve(t *testing.T) {
+	// Pixels are resolved at 96 DPI, so 4 pixels are 3 points
+	size := image.Pt(3000, 4000)
+
+	tests := []struct {
+		name    string
+		length  Length
+		dpi     float64
+		want    float64
+		wantErr bool
+	}{
+		{name: "points", length: Points(40), want: 40},
+		{name: "points ignore the dpi", length: Points(40), dpi: 300, want: 40},
+		{name: "percent of the diagonal", length: Length{Value: 2, Unit: UnitPercentDiagonal}, want: 100 * 0.75},
+		{name: "percent of the width", length: Length{Value: 2, Unit: UnitPercentWidth}, want: 60 * 0.75},
+		{name: "millimetres", length: Length{Value: 25.4, Unit: UnitMillimetres}, dpi: 300, want: 300 * 0.75},
+		{name: "millimetres without dpi", length: Length{Value: 5, Unit: UnitMillimetres}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.length.resolve(size, tt.dpi)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "DPI") {
+					t.Errorf("resolve() = %v, %v, want an error about the unknown DPI", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve() error = %v", err)
+			}
+			if math.Abs(float64(got)-tt.want) > 1e-9 {
+				t.Errorf("resolve() = %v, want %v", float64(got), tt.want)
+			}
+		})
+	}
+}
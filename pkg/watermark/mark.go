@@ -0,0 +1,38 @@
+package watermark
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// markPlaceholder stands in for the forensic mark before one is assigned,
+// so the text can be laid out with the width it will have
+const markPlaceholder = "00000000"
+
+// newMark returns a random identifier for a single output
+func newMark() (string, error) {
+	var id [4]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", fmt.Errorf("generating forensic mark: %w", err)
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+// withMark returns a processor for a single output, with a new forensic mark
+// when they are enabled. The configuration is copied, so processors can be
+// shared between workers.
+func (p *Processor) withMark() (*Processor, error) {
+	if !p.config.ForensicMark {
+		return p, nil
+	}
+
+	mark, err := newMark()
+	if err != nil {
+		return nil, err
+	}
+
+	config := *p.config
+	config.Mark = mark
+	return &Processor{config: &config}, nil
+}
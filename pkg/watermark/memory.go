@@ -0,0 +1,96 @@
+package watermark
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// byteSizePattern matches sizes such as 512MB, 1.5GiB or 2g
+var byteSizePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([kmgt]?)(i?)b?$`)
+
+// byteSizeUnits are the exponents of the size prefixes
+var byteSizeUnits = map[string]int{"": 0, "k": 1, "m": 2, "g": 3, "t": 4}
+
+// ParseByteSize parses a size in bytes, with an optional decimal (KB, MB, GB,
+// TB) or binary (KiB, MiB, GiB, TiB) unit. An empty size is zero.
+func ParseByteSize(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+
+	match := byteSizePattern.FindStringSubmatch(s)
+	if match == nil {
+		return 0, fmt.Errorf("invalid size %q (expected a number of bytes with an optional unit such as MB or GiB)", s)
+	}
+	value, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", s, err)
+	}
+
+	base := 1000.0
+	if match[3] != "" {
+		base = 1024
+	}
+	for i := 0; i < byteSizeUnits[match[2]]; i++ {
+		value *= base
+	}
+	return int64(value), nil
+}
+
+// imageMemory estimates the memory needed to watermark an image of the
+// given size: the decoded input and the result, and the diagonal canvas the
+// watermark is drawn on, with its encoded and decoded copies, at 4 bytes
+// per pixel
+func imageMemory(width, height int) int64 {
+	w, h := int64(width), int64(height)
+	return 4 * (3*w*h + 3*(w*w+h*h))
+}
+
+// fileMemory estimates the memory needed to watermark an image file from its
+// dimensions, which are read without decoding it. It returns zero when the
+// file cannot be read, as processing it fails early.
+func fileMemory(path string) int64 {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0
+	}
+	return imageMemory(config.Width, config.Height)
+}
+
+// reserve waits until the memory estimated for an image file fits in the
+// memory budget, and returns the function that releases it. An image that
+// needs more than the whole budget is processed alone. It returns an error
+// only when ctx is cancelled while waiting.
+func (bp *BatchProcessor) reserve(ctx context.Context, path string) (func(), error) {
+	if bp.memory == nil {
+		return func() {}, nil
+	}
+
+	weight := fileMemory(path)
+	if weight > bp.memoryBudget {
+		bp.logger.WithFields(logrus.Fields{
+			"file":     path,
+			"estimate": weight,
+			"budget":   bp.memoryBudget,
+		}).Warn("Image needs more memory than the budget, processing it alone")
+		weight = bp.memoryBudget
+	}
+	if err := bp.memory.Acquire(ctx, weight); err != nil {
+		return nil, err
+	}
+	return func() { bp.memory.Release(weight) }, nil
+}
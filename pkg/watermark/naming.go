@@ -0,0 +1,170 @@
+package watermark
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Layout is how the outputs of a directory batch are arranged
+type Layout string
+
+const (
+	// LayoutMirror writes every output to the same subdirectory as its input
+	LayoutMirror Layout = "mirror"
+	// LayoutFlatten writes every output directly to the output directory
+	LayoutFlatten Layout = "flatten"
+)
+
+// DefaultNameTemplate keeps the name of the input
+const DefaultNameTemplate = "{stem}{ext}"
+
+// namePlaceholders are the placeholders of a name template
+var namePlaceholders = map[string]bool{
+	"{stem}":    true,
+	"{ext}":     true,
+	"{date}":    true,
+	"{company}": true,
+	"{hash8}":   true,
+}
+
+// placeholderPattern finds the placeholders of a name template
+var placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// unsafeNameChars are replaced in names taken from settings, such as the company
+var unsafeNameChars = regexp.MustCompile(`[/\\:*?"<>|\x00-\x1f]+`)
+
+// outputFormats maps the formats outputs can be converted to to their extension
+var outputFormats = map[string]string{
+	"jpeg": ".jpg",
+	"jpg":  ".jpg",
+	"png":  ".png",
+}
+
+// outputNamer names the outputs of a directory batch. It is used by a
+// single goroutine, as it tracks the names already taken.
+type outputNamer struct {
+	template string
+	layout   Layout
+	ext      string
+	date     string
+	// taken maps the names given out to the inputs they were given to
+	taken map[string]string
+	// existingDir, when set, is the output directory, whose files are taken
+	// names too, so outputs do not replace those of earlier inputs
+	existingDir string
+}
+
+// newOutputNamer validates the template, layout and format of the outputs
+func newOutputNamer(template string, layout Layout, format string) (*outputNamer, error) {
+	if template == "" {
+		template = DefaultNameTemplate
+	}
+	for _, placeholder := range placeholderPattern.FindAllString(template, -1) {
+		if !namePlaceholders[placeholder] {
+			return nil, fmt.Errorf("unknown placeholder %s in name template (expected {stem}, {ext}, {date}, {company} or {hash8})", placeholder)
+		}
+	}
+	if strings.ContainsAny(template, `/\`) {
+		return nil, fmt.Errorf("name template %q names the file only, so it cannot contain a path separator", template)
+	}
+
+	switch layout {
+	case "":
+		layout = LayoutMirror
+	case LayoutMirror, LayoutFlatten:
+	default:
+		return nil, fmt.Errorf("unknown layout %q (expected mirror or flatten)", layout)
+	}
+
+	namer := &outputNamer{
+		template: template,
+		layout:   layout,
+		date:     time.Now().Format("2006-01-02"),
+		taken:    make(map[string]string),
+	}
+	if format != "" {
+		if namer.ext = outputFormats[strings.ToLower(format)]; namer.ext == "" {
+			return nil, fmt.Errorf("unsupported output format %q (expected jpeg or png)", format)
+		}
+	}
+	return namer, nil
+}
+
+// usesHash reports whether names need the hash of the input
+func (n *outputNamer) usesHash() bool {
+	return strings.Contains(n.template, "{hash8}")
+}
+
+// name returns the output path of an input, relative to the output
+// directory and with forward slashes. relPath is the input path relative to
+// the input directory. Names without an image extension get the extension of
+// the output format or the input. A name taken by the output of another input gets a
+// number, so outputs never overwrite each other, while an input named again,
+// such as a changed file in watch mode, keeps its name until it is released.
+func (n *outputNamer) name(relPath, company, inputHash string) string {
+	base := path.Base(relPath)
+	ext := path.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	if n.ext != "" {
+		ext = n.ext
+	}
+	if len(inputHash) > 8 {
+		inputHash = inputHash[:8]
+	}
+
+	name := strings.NewReplacer(
+		"{stem}", stem,
+		"{ext}", ext,
+		"{date}", n.date,
+		"{company}", strings.TrimSpace(unsafeNameChars.ReplaceAllString(company, "_")),
+		"{hash8}", inputHash,
+	).Replace(n.template)
+
+	// The extension decides the format the output is written in, so names
+	// without one, such as from "{stem}_wm_{date}", get that of the output
+	if !isSupportedExt(path.Ext(name)) {
+		name += ext
+	}
+
+	output := name
+	if dir := path.Dir(relPath); n.layout == LayoutMirror && dir != "." {
+		output = path.Join(dir, name)
+	}
+
+	// Number names taken by other inputs, before the extension
+	outputExt := path.Ext(output)
+	outputStem := strings.TrimSuffix(output, outputExt)
+	for i := 1; n.isTaken(output, relPath); i++ {
+		output = fmt.Sprintf("%s_%d%s", outputStem, i, outputExt)
+	}
+	n.taken[output] = relPath
+	return output
+}
+
+// isTaken reports whether a name is taken by another input, or by a file
+// in the output directory when existing files are kept
+func (n *outputNamer) isTaken(output, relPath string) bool {
+	if owner := n.taken[output]; owner != "" {
+		return owner != relPath
+	}
+	if n.existingDir == "" {
+		return false
+	}
+	_, err := os.Lstat(filepath.Join(n.existingDir, filepath.FromSlash(output)))
+	return err == nil
+}
+
+// release frees the names given to an input, such as once it has been
+// archived, so a later input at the same path gets a name of its own
+func (n *outputNamer) release(relPath string) {
+	for output, owner := range n.taken {
+		if owner == relPath {
+			delete(n.taken, output)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package watermark
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutputNamerName(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		layout   Layout
+		format   string
+		relPath  string
+		want     string
+	}{
+		{name: "default", relPath: "sub/scan.JPG", want: "sub/scan.JPG"},
+		{name: "flatten", layout: LayoutFlatten, relPath: "sub/scan.jpg", want: "scan.jpg"},
+		{name: "placeholders", template: "{company}_{stem}_{date}_{hash8}{ext}", relPath: "scan.png", want: "ACME_Co_scan_2026-10-18_0123abcd.png"},
+		{name: "output format", format: "jpeg", relPath: "scan.png", want: "scan.jpg"},
+		{name: "no extension gets the input's", template: "{stem}_wm_{date}", relPath: "scan.png", want: "scan_wm_2026-10-18.png"},
+		{name: "no extension gets the output format's", template: "{stem}_wm", format: "png", relPath: "scan.jpg", want: "scan_wm.png"},
+		{name: "dotted name gets an extension", template: "{stem}_v1.2", relPath: "scan.jpg", want: "scan_v1.2.jpg"},
+		{name: "explicit extension kept", template: "{stem}.png", relPath: "scan.jpg", want: "scan.png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namer, err := newOutputNamer(tt.template, tt.layout, tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			namer.date = "2026-10-18"
+			if got := namer.name(tt.relPath, "ACME/Co", "0123abcdef"); got != tt.want {
+				t.Errorf("name(%s) = %s, want %s", tt.relPath, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputNamerCollisions(t *testing.T) {
+	namer, err := newOutputNamer("{stem}_wm", LayoutFlatten, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []struct {
+		relPath string
+		want    string
+	}{
+		{"a/scan.jpg", "scan_wm.jpg"},
+		{"b/scan.jpg", "scan_wm_1.jpg"},
+		{"c/scan.jpg", "scan_wm_2.jpg"},
+		// An input named again keeps its name
+		{"a/scan.jpg", "scan_wm.jpg"},
+	}
+	for _, n := range names {
+		if got := namer.name(n.relPath, "", ""); got != n.want {
+			t.Errorf("name(%s) = %s, want %s", n.relPath, got, n.want)
+		}
+	}
+}
+
+func TestOutputNamerExistingOutputs(t *testing.T) {
+	dir := t.TempDir()
+	namer, err := newOutputNamer("", LayoutMirror, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	namer.existingDir = dir
+
+	if got := namer.name("scan.jpg", "", ""); got != "scan.jpg" {
+		t.Fatalf("name(scan.jpg) = %s, want scan.jpg", got)
+	}
+	// The input keeps its name while it is not released, even once its
+	// output exists
+	if err := os.WriteFile(filepath.Join(dir, "scan.jpg"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := namer.name("scan.jpg", "", ""); got != "scan.jpg" {
+		t.Errorf("name(scan.jpg) before release = %s, want scan.jpg", got)
+	}
+
+	// Once released, such as after archiving, a new input at the same path
+	// does not replace the output
+	namer.release("scan.jpg")
+	if got := namer.name("scan.jpg", "", ""); got != "scan_1.jpg" {
+		t.Errorf("name(scan.jpg) after release = %s, want scan_1.jpg", got)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "scan_1.jpg"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	namer.release("scan.jpg")
+	if got := namer.name("scan.jpg", "", ""); got != "scan_2.jpg" {
+		t.Errorf("name(scan.jpg) after second release = %s, want scan_2.jpg", got)
+	}
+}
+
+func TestNewOutputNamerInvalid(t *testing.T) {
+	tests := []struct {
+		template string
+		layout   Layout
+		format   string
+	}{
+		{template: "{stem}{size}"},
+		{template: "out/{stem}{ext}"},
+		{layout: "tree"},
+		{format: "gif"},
+	}
+	for _, tt := range tests {
+		if _, err := newOutputNamer(tt.template, tt.layout, tt.format); err == nil {
+			t.Errorf("newOutputNamer(%q, %q, %q) succeeded, want an error", tt.template, tt.layout, tt.format)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package watermark
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image/color"
+	"path/filepath"
+	"strings"
+)
+
+// ErrorClass groups processing errors by the stage that failed
+type ErrorClass string
+
+const (
+	// ErrorClassConfig is an invalid config, such as a bad directory config file
+	ErrorClassConfig ErrorClass = "config"
+	// ErrorClassInput is an input file that cannot be read or decoded
+	ErrorClassInput ErrorClass = "input"
+	// ErrorClassProcessing is a failure while preparing or watermarking the image
+	ErrorClassProcessing ErrorClass = "processing"
+	// ErrorClassOutput is an output file that cannot be written
+	ErrorClassOutput ErrorClass = "output"
+	// ErrorClassOther is an error without a class
+	ErrorClassOther ErrorClass = "other"
+)
+
+// classError is an error with the stage that failed
+type classError struct {
+	class ErrorClass
+	err   error
+}
+
+func (e *classError) Error() string { return e.err.Error() }
+func (e *classError) Unwrap() error { return e.err }
+
+// classify marks an error with the stage that failed
+func classify(class ErrorClass, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classError{class: class, err: err}
+}
+
+// ClassOf returns the class of an error returned by processing
+func ClassOf(err error) ErrorClass {
+	var ce *classError
+	if errors.As(err, &ce) {
+		return ce.class
+	}
+	return ErrorClassOther
+}
+
+// Params are the effective watermark parameters of an output, for reports
+type Params struct {
+	Text            string `json:"text"`
+	FontSize        string `json:"font_size"`
+	TextSpacing     string `json:"text_spacing"`
+	LineSpacing     string `json:"line_spacing"`
+	Opacity         uint8  `json:"opacity"`
+	Color           string `json:"color"`
+	StrokeColor     string `json:"stroke_color,omitempty"`
+	BackgroundColor string `json:"background_color,omitempty"`
+	Quality         int    `json:"quality,omitempty"`
+	Redactions      int    `json:"redactions,omitempty"`
+}
+
+// params returns the effective parameters of the config
+func (c *Config) params() Params {
+	return Params{
+		Text:            c.Text(),
+		FontSize:        c.FontSize.String(),
+		TextSpacing:     c.TextSpacing.String(),
+		LineSpacing:     c.LineSpacing.String(),
+		Opacity:         c.Opacity,
+		Color:           hexColor(c.WatermarkColor),
+		StrokeColor:     hexColor(c.StrokeColor),
+		BackgroundColor: hexColor(c.BackgroundColor),
+		Quality:         c.Quality,
+		Redactions:      len(c.Redactions),
+	}
+}
+
+// hexColor formats a color as #RRGGBBAA, or an empty string when it is not drawn
+func hexColor(c color.RGBA) string {
+	if c.A == 0 {
+		return ""
+	}
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return fmt.Sprintf("#%02x%02x%02x%02x", n.R, n.G, n.B, n.A)
+}
+
+// imageFormat returns the format of an image file from its extension
+func imageFormat(path string) string {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".jpg", ".jpeg":
+		return "jpeg"
+	default:
+		return strings.TrimPrefix(ext, ".")
+	}
+}
+
+// hashBytes returns the hex-encoded SHA-256 hash of data
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,49 @@
+package watermark
+
+import "testing"
+
+func TestShapeArabic(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		shaped []rune
+	}{
+		{"isolated", "ب", []rune{0xFE8F}},
+		{"initial and final", "بب", []rune{0xFE91, 0xFE90}},
+		{"medial", "ببب", []rune{0xFE91, 0xFE92, 0xFE90}},
+		{"right-joining letter breaks the word", "مرحبا", []rune{0xFEE3, 0xFEAE, 0xFEA3, 0xFE92, 0xFE8E}},
+		{"isolated lam-alef", "لا", []rune{0xFEFB}},
+		{"final lam-alef", "بلا", []rune{0xFE91, 0xFEFC}},
+		{"lam-alef with hamza", "لأ", []rune{0xFEF7}},
+		{"marks are transparent", "بَب", []rune{0xFE91, 0x064E, 0xFE90}},
+		{"latin untouched", "ACME", []rune("ACME")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := []rune(shapeArabic(tt.text)); string(got) != string(tt.shaped) {
+				t.Errorf("shapeArabic(%q) = %U, want %U", tt.text, got, tt.shaped)
+			}
+		})
+	}
+}
+
+func TestDisplayTextMixedRuns(t *testing.T) {
+	tests := []struct {
+		text    string
+		display []rune
+	}{
+		// Arabic is shaped in logical order, then reordered with the number
+		// staying left-to-right
+		{"ACME مرحبا 123", append([]rune("ACME 123 "), 0xFE8E, 0xFE92, 0xFEA3, 0xFEAE, 0xFEE3)},
+		{"مرحبا ١٢٣ ACME", append([]rune("ACME ١٢٣ "), 0xFE8E, 0xFE92, 0xFEA3, 0xFEAE, 0xFEE3)},
+		{"ACME - שלום - 2026-10-16", []rune("ACME - 2026-10-16 - םולש")},
+	}
+
+	for _, tt := range tests {
+		config := &Config{TextTemplate: tt.text}
+		if got := []rune(config.DisplayText()); string(got) != string(tt.display) {
+			t.Errorf("DisplayText() of %q = %U, want %U", tt.text, got, tt.display)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package watermark
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// StateFile is the name of the file in the output directory that records
+// the files a batch processed, so unchanged files are skipped when the
+// batch is run again. Entries are appended as files are done, so an
+// interrupted batch can be resumed.
+const StateFile = ".id-watermark-state.jsonl"
+
+// stateEntry records the input and settings an output was made from
+type stateEntry struct {
+	// Output is the path of the output, relative to the output directory
+	Output     string `json:"output"`
+	InputHash  string `json:"input_sha256"`
+	ConfigHash string `json:"config_sha256"`
+	OutputHash string `json:"output_sha256"`
+}
+
+// batchState is the state file of an output directory
+type batchState struct {
+	path    string
+	entries map[string]stateEntry
+	file    *os.File
+}
+
+// loadState reads the state file of an output directory, if any, and opens
+// it for appending
+func loadState(outputDir string) (*batchState, error) {
+	state := &batchState{
+		path:    filepath.Join(outputDir, StateFile),
+		entries: make(map[string]stateEntry),
+	}
+
+	file, err := os.Open(state.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("reading state file: %w", err)
+	}
+	if err == nil {
+		// Later entries replace earlier ones, and a line cut short by an
+		// interrupted run is ignored
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var entry stateEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry.Output != "" {
+				state.entries[entry.Output] = entry
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("reading state file: %w", err)
+		}
+	}
+
+	state.file, err = os.OpenFile(state.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening state file: %w", err)
+	}
+	return state, nil
+}
+
+// unchanged reports whether an output was made from the same input and
+// settings, and is still the file that was written
+func (e *stateEntry) unchanged(inputPath, outputPath, configHash string) bool {
+	if configHash == "" || e.ConfigHash != configHash {
+		return false
+	}
+	return hashFile(inputPath) == e.InputHash && hashFile(outputPath) == e.OutputHash
+}
+
+// record appends an entry for a processed file
+func (s *batchState) record(entry stateEntry) error {
+	s.entries[entry.Output] = entry
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+// close rewrites the state file with a single entry per output
+func (s *batchState) close() error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("closing state file: %w", err)
+	}
+
+	outputs := make([]string, 0, len(s.entries))
+	for output := range s.entries {
+		outputs = append(outputs, output)
+	}
+	sort.Strings(outputs)
+
+	tmp := s.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("writing state file: %w", err)
+	}
+	encoder := json.NewEncoder(file)
+	for _, output := range outputs {
+		if err := encoder.Encode(s.entries[output]); err != nil {
+			file.Close()
+			return fmt.Errorf("writing state file: %w", err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("writing state file: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// hashFile returns the hex-encoded SHA-256 hash of a file, or an empty
+// string if it cannot be read
+func hashFile(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,268 @@
+package watermark
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"image/color"
+	"image/png"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConfig returns a valid config with the embedded sans font, with a
+// fingerprint so batches record their state
+func testConfig(t *testing.T) *Config {
+	t.Helper()
+	fm, _ := testFontManager(t)
+	font, err := fm.LoadFont("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Config{
+		CompanyName:    "ACME",
+		Timestamp:      time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		FontSize:       Points(12),
+		Opacity:        128,
+		Angle:          -30,
+		Font:           font,
+		TextSpacing:    Points(20),
+		LineSpacing:    Points(20),
+		Quality:        90,
+		WatermarkColor: color.RGBA{R: 255, A: 255},
+		Fingerprint:    "test",
+	}
+}
+
+// writeImages writes small PNG images at the given slash-separated paths below dir
+func writeImages(t *testing.T, dir string, paths ...string) {
+	t.Helper()
+	for _, p := range paths {
+		file := filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(f, uniformImage(64, 48, color.RGBA{R: 200, G: 200, B: 200, A: 255})); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// writeState writes a state file with the given content to dir
+func writeState(t *testing.T, dir, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, StateFile), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	a := `{"output":"a.png","input_sha256":"1","config_sha256":"c","output_sha256":"2"}`
+	b := `{"output":"b.png","input_sha256":"3","config_sha256":"c","output_sha256":"4"}`
+	a2 := `{"output":"a.png","input_sha256":"5","config_sha256":"c","output_sha256":"6"}`
+
+	tests := []struct {
+		name    string
+		content *string
+		want    map[string]string // output to input hash
+	}{
+		{name: "no state file", want: map[string]string{}},
+		{name: "empty", content: ptr(""), want: map[string]string{}},
+		{name: "entries", content: ptr(a + "\n" + b + "\n"), want: map[string]string{"a.png": "1", "b.png": "3"}},
+		{name: "later entry replaces earlier", content: ptr(a + "\n" + b + "\n" + a2 + "\n"), want: map[string]string{"a.png": "5", "b.png": "3"}},
+		{name: "truncated last line", content: ptr(a + "\n" + b[:30]), want: map[string]string{"a.png": "1"}},
+		{name: "invalid and empty lines", content: ptr("garbage\n\n{}\n" + b + "\n"), want: map[string]string{"b.png": "3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.content != nil {
+				writeState(t, dir, *tt.content)
+			}
+
+			state, err := loadState(dir)
+			if err != nil {
+				t.Fatalf("loadState() error = %v", err)
+			}
+			defer state.file.Close()
+
+			got := make(map[string]string, len(state.entries))
+			for output, entry := range state.entries {
+				got[output] = entry.InputHash
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("loadState() entries = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStateEntryUnchanged(t *testing.T) {
+	tests := []struct {
+		name       string
+		configHash string
+		change     string // file changed after the entry was recorded
+		want       bool
+	}{
+		{name: "unchanged", configHash: "c", want: true},
+		{name: "other config", configHash: "d"},
+		{name: "no config hash", configHash: ""},
+		{name: "input changed", configHash: "c", change: "input"},
+		{name: "output changed", configHash: "c", change: "output"},
+		{name: "output removed", configHash: "c", change: "removed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			input, output := filepath.Join(dir, "input.png"), filepath.Join(dir, "output.png")
+			for path, content := range map[string]string{input: "input", output: "output"} {
+				if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			entry := stateEntry{Output: "output.png", InputHash: hashFile(input), ConfigHash: "c", OutputHash: hashFile(output)}
+
+			var err error
+			switch tt.change {
+			case "input":
+				err = os.WriteFile(input, []byte("other input"), 0644)
+			case "output":
+				err = os.WriteFile(output, []byte("other output"), 0644)
+			case "removed":
+				err = os.Remove(output)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := entry.unchanged(input, output, tt.configHash); got != tt.want {
+				t.Errorf("unchanged() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStateClose(t *testing.T) {
+	dir := t.TempDir()
+	writeState(t, dir, `{"output":"b.png","input_sha256":"1"}`+"\n"+`{"output":"a.png","input_sha256":"2"}`+"\n"+`{"output":"b.png","input_sha256":"3"`)
+
+	state, err := loadState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []stateEntry{{Output: "c.png", InputHash: "4"}, {Output: "a.png", InputHash: "5"}} {
+		if err := state.record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := state.close(); err != nil {
+		t.Fatalf("close() error = %v", err)
+	}
+
+	// Every output is written once, sorted, with its latest entry
+	file, err := os.Open(filepath.Join(dir, StateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var got []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry stateEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid state line %q: %v", scanner.Text(), err)
+		}
+		got = append(got, entry.Output+"="+entry.InputHash)
+	}
+	if want := []string{"a.png=5", "b.png=1", "c.png=4"}; !slices.Equal(got, want) {
+		t.Errorf("state file = %v, want %v", got, want)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, StateFile+".tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary state file left behind: %v", err)
+	}
+}
+
+func TestProcessDirectoryState(t *testing.T) {
+	inputDir, outputDir := t.TempDir(), t.TempDir()
+	writeImages(t, inputDir, "a.png", "b.png", "sub/c.png")
+
+	tests := []struct {
+		name        string
+		force       bool
+		change      func(t *testing.T)
+		wantSuccess int
+		wantSkipped int
+	}{
+		{name: "first run", wantSuccess: 3},
+		{name: "unchanged", wantSkipped: 3},
+		{
+			name: "input changed",
+			change: func(t *testing.T) {
+				appendFile(t, filepath.Join(inputDir, "a.png"), "more data")
+			},
+			wantSuccess: 1,
+			wantSkipped: 2,
+		},
+		{
+			name: "output changed",
+			change: func(t *testing.T) {
+				if err := os.WriteFile(filepath.Join(outputDir, "b.png"), []byte("edited"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantSuccess: 1,
+			wantSkipped: 2,
+		},
+		{name: "force", force: true, wantSuccess: 3},
+		{name: "unchanged after force", wantSkipped: 3},
+	}
+
+	config := testConfig(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.change != nil {
+				tt.change(t)
+			}
+
+			bp := newTestBatchProcessor(t, config, BatchOptions{Recursive: true, Force: tt.force})
+			result, err := bp.ProcessDirectory(context.Background(), inputDir, outputDir)
+			if err != nil {
+				t.Fatalf("ProcessDirectory() error = %v", err)
+			}
+			if result.ErrorCount > 0 {
+				t.Fatalf("ProcessDirectory() errors = %v", result.Errors)
+			}
+			if result.SuccessCount != tt.wantSuccess || result.SkippedCount != tt.wantSkipped {
+				t.Errorf("processed %d and skipped %d files, want %d and %d", result.SuccessCount, result.SkippedCount, tt.wantSuccess, tt.wantSkipped)
+			}
+
+			data, err := os.ReadFile(filepath.Join(outputDir, StateFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lines := strings.Count(string(data), "\n"); lines != 3 {
+				t.Errorf("state file has %d lines, want one per output", lines)
+			}
+		})
+	}
+}
+
+// ptr returns a pointer to a copy of v
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,167 @@
+package watermark
+
+import (
+	"fmt"
+	"unicode"
+
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"gonum.org/v1/plot/font"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/vgimg"
+)
+
+// textRun is a part of the watermark text drawn with a single font
+type textRun struct {
+	text  string
+	face  font.Face
+	width vg.Length
+}
+
+// textLine is the watermark text split into runs, ready to be drawn
+type textLine struct {
+	runs  []textRun
+	width vg.Length
+}
+
+// fontChain returns the primary font followed by the fallback fonts
+func (c *Config) fontChain() []*opentype.Font {
+	return append([]*opentype.Font{c.Font}, c.FallbackFonts...)
+}
+
+// UncoveredRunes returns the characters of the watermark text that none of
+// the configured fonts has a glyph for
+func UncoveredRunes(config *Config) []rune {
+	var uncovered []rune
+	for _, r := range MissingRunes(config.Font, config.DisplayText()) {
+		if fontFor(config.fontChain(), r, nil) < 0 {
+			uncovered = append(uncovered, r)
+		}
+	}
+	return uncovered
+}
+
+// Density returns the fraction of an image covered by the watermark text:
+// the share of each line pitch taken by the text height, times the share of
+// each horizontal repeat taken by the text width. Without an image, it can
+// only be computed when the font size and spacing are in units that compare
+// directly, such as all in points and millimetres or all in the same
+// relative unit.
+func (c *Config) Density() (float64, bool) {
+	sizes := []Length{c.FontSize, c.TextSpacing, c.LineSpacing}
+	absolute := func(u Unit) bool { return u == UnitPoints || u == UnitMillimetres }
+
+	values := make([]vg.Length, len(sizes))
+	for i, l := range sizes {
+		switch {
+		case l.Unit == UnitMillimetres && absolute(sizes[0].Unit):
+			values[i] = vg.Length(l.Value) * vg.Millimeter
+		case l.Unit == sizes[0].Unit || (absolute(l.Unit) && absolute(sizes[0].Unit)):
+			values[i] = vg.Length(l.Value)
+		default:
+			return 0, false
+		}
+	}
+
+	// Relative sizes are laid out as if they were points, which keeps the ratios
+	fontSize := values[0]
+	width := layoutText(c.fontChain(), c.DisplayText(), fontSize).width
+	return density(width, fontSize, values[1], values[2]), true
+}
+
+// density returns the fraction of an image covered by text rows of the given
+// size and spacing
+func density(textWidth, fontSize, xDistance, yDistance vg.Length) float64 {
+	if textWidth <= 0 || fontSize <= 0 {
+		return 0
+	}
+	return float64(fontSize/(fontSize+yDistance)) * float64(textWidth/(textWidth+xDistance))
+}
+
+// layoutText splits the text into runs, switching to the first font in the
+// chain that has a glyph for each character. Whitespace and characters no
+// font covers stay in the current run.
+func layoutText(fonts []*opentype.Font, text string, size vg.Length) textLine {
+	faces := make([]font.Face, len(fonts))
+	for i, f := range fonts {
+		faces[i] = font.Face{
+			Font: font.Font{Typeface: font.Typeface(fmt.Sprintf("WatermarkFont%d", i)), Size: size},
+			Face: f,
+		}
+	}
+
+	var buf sfnt.Buffer
+	var line textLine
+	current, start := 0, 0
+	runes := []rune(text)
+	for i, r := range runes {
+		index := current
+		if !unicode.IsSpace(r) {
+			if found := fontFor(fonts, r, &buf); found >= 0 {
+				index = found
+			}
+		}
+
+		if index != current && i > start {
+			line.runs = append(line.runs, textRun{text: string(runes[start:i]), face: faces[current]})
+			start = i
+		}
+		current = index
+	}
+	if start < len(runes) {
+		line.runs = append(line.runs, textRun{text: string(runes[start:]), face: faces[current]})
+	}
+
+	for i := range line.runs {
+		line.runs[i].width = line.runs[i].face.Width(line.runs[i].text)
+		line.width += line.runs[i].width
+	}
+
+	return line
+}
+
+// fontFor returns the index of the first font with a glyph for r, or -1
+func fontFor(fonts []*opentype.Font, r rune, buf *sfnt.Buffer) int {
+	if buf == nil {
+		buf = &sfnt.Buffer{}
+	}
+	for i, f := range fonts {
+		if index, err := f.GlyphIndex(buf, r); err == nil && index != 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// strokeDirections are the unit offsets text is shifted by to outline it
+var strokeDirections = []vg.Point{
+	{X: 1, Y: 0}, {X: -1, Y: 0}, {X: 0, Y: 1}, {X: 0, Y: -1},
+	{X: 0.7071, Y: 0.7071}, {X: -0.7071, Y: 0.7071}, {X: 0.7071, Y: -0.7071}, {X: -0.7071, Y: -0.7071},
+}
+
+// stroke outlines the line by drawing it shifted by width in eight
+// directions around pt, so the text drawn on top gets a border
+func (l textLine) stroke(c *vgimg.Canvas, pt vg.Point, width vg.Length) {
+	for _, d := range strokeDirections {
+		l.draw(c, vg.Point{X: pt.X + d.X*width, Y: pt.Y + d.Y*width})
+	}
+}
+
+// bandPath returns a rectangle spanning [x0, x1] and [y0, y1]
+func bandPath(x0, x1, y0, y1 vg.Length) vg.Path {
+	var path vg.Path
+	path.Move(vg.Point{X: x0, Y: y0})
+	path.Line(vg.Point{X: x1, Y: y0})
+	path.Line(vg.Point{X: x1, Y: y1})
+	path.Line(vg.Point{X: x0, Y: y1})
+	path.Close()
+	return path
+}
+
+// draw draws the runs of the line one after another starting at pt
+func (l textLine) draw(c *vgimg.Canvas, pt vg.Point) {
+	for _, run := range l.runs {
+		c.FillString(run.face, pt, run.text)
+		pt.X += run.width
+	}
+}
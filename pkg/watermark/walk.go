@@ -0,0 +1,209 @@
+package watermark
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// supportedExts are the extensions of the image files a batch processes
+var supportedExts = []string{".jpg", ".jpeg", ".png"}
+
+// isSupportedExt reports whether an extension is that of an image file a
+// batch processes and can write
+func isSupportedExt(ext string) bool {
+	return slices.Contains(supportedExts, strings.ToLower(ext))
+}
+
+// fileFilter selects the image files of a batch. Patterns are doublestar
+// globs matched against paths relative to the input directory, with forward
+// slashes; a pattern without a slash is matched against the name only.
+type fileFilter struct {
+	include []string
+	exclude []string
+}
+
+// newFileFilter validates the include and exclude patterns
+func newFileFilter(include, exclude []string) (*fileFilter, error) {
+	for _, patterns := range [][]string{include, exclude} {
+		for _, pattern := range patterns {
+			if !doublestar.ValidatePattern(pattern) {
+				return nil, fmt.Errorf("invalid pattern %q", pattern)
+			}
+		}
+	}
+	return &fileFilter{include: include, exclude: exclude}, nil
+}
+
+// matchAny reports whether a relative path matches any of the patterns
+func matchAny(patterns []string, relPath string) bool {
+	for _, pattern := range patterns {
+		name := relPath
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(relPath)
+		}
+		if doublestar.MatchUnvalidated(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludesDir reports whether a directory and everything below it is excluded
+func (f *fileFilter) excludesDir(relPath string) bool {
+	return matchAny(f.exclude, relPath)
+}
+
+// selects reports whether a file is a supported image that is included and
+// not excluded
+func (f *fileFilter) selects(relPath string) bool {
+	if !isSupportedExt(path.Ext(relPath)) || matchAny(f.exclude, relPath) {
+		return false
+	}
+	return len(f.include) == 0 || matchAny(f.include, relPath)
+}
+
+// walker finds the image files below an input directory
+type walker struct {
+	logger *logrus.Logger
+	filter *fileFilter
+	// maxDepth is the deepest level searched, where the files of the input
+	// directory are at level 1, or 0 for no limit
+	maxDepth       int
+	followSymlinks bool
+	files          []string
+}
+
+// walk adds the selected files of a directory, and of its subdirectories up
+// to the maximum depth. ancestors are the directories walked to reach it,
+// so symlinks leading back to one of them are not followed in a loop.
+func (w *walker) walk(dir, relDir string, depth int, ancestors []os.FileInfo) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		filePath := filepath.Join(dir, entry.Name())
+		relPath := path.Join(relDir, entry.Name())
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if !w.followSymlinks {
+				w.logger.WithField("path", filePath).Debug("Skipped symlink")
+				continue
+			}
+			if info, err = os.Stat(filePath); err != nil {
+				w.logger.WithError(err).WithField("path", filePath).Warn("Skipped broken symlink")
+				continue
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			if w.maxDepth > 0 && depth >= w.maxDepth {
+				continue
+			}
+			if w.filter.excludesDir(relPath) {
+				w.logger.WithField("path", filePath).Debug("Skipped excluded directory")
+				continue
+			}
+			if isAncestor(info, ancestors) {
+				w.logger.WithField("path", filePath).Warn("Skipped symlink loop")
+				continue
+			}
+			if err := w.walk(filePath, relPath, depth+1, append(ancestors, info)); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular() && w.filter.selects(relPath):
+			w.files = append(w.files, filePath)
+		}
+	}
+	return nil
+}
+
+// isAncestor reports whether a directory is one of the ancestors
+func isAncestor(dir os.FileInfo, ancestors []os.FileInfo) bool {
+	for _, ancestor := range ancestors {
+		if os.SameFile(dir, ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+// findImageFiles finds the selected image files in the given directory,
+// descending into subdirectories when recursive
+func (bp *BatchProcessor) findImageFiles(inputDir string) ([]string, error) {
+	root, err := os.Stat(inputDir)
+	if err != nil {
+		return nil, err
+	}
+	if !root.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", inputDir)
+	}
+
+	w := &walker{
+		logger:         bp.logger,
+		filter:         bp.filter,
+		maxDepth:       bp.maxDepth,
+		followSymlinks: bp.followSymlinks,
+	}
+	if !bp.recursive {
+		w.maxDepth = 1
+	}
+	if err := w.walk(inputDir, "", 1, []os.FileInfo{root}); err != nil {
+		return nil, err
+	}
+	return w.files, nil
+}
+
+// listedImageFiles resolves a list of files and keeps the selected ones.
+// Relative paths are relative to the working directory, as given by tools
+// such as find, and every file must be inside the input directory. Files
+// listed more than once are kept once.
+func (bp *BatchProcessor) listedImageFiles(inputDir string, files []string) ([]string, error) {
+	absDir, err := filepath.Abs(inputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var imageFiles []string
+	listed := make(map[string]bool)
+	for _, file := range files {
+		absFile, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		relPath, err := filepath.Rel(absDir, absFile)
+		if err != nil {
+			return nil, err
+		}
+		if relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("%s is not inside %s", file, inputDir)
+		}
+		file = filepath.Join(inputDir, relPath)
+
+		if listed[relPath] {
+			bp.logger.WithField("file", file).Debug("Skipped file listed again")
+			continue
+		}
+		listed[relPath] = true
+
+		if !bp.filter.selects(filepath.ToSlash(relPath)) {
+			bp.logger.WithField("file", file).Debug("Skipped listed file")
+			continue
+		}
+		imageFiles = append(imageFiles, file)
+	}
+	return imageFiles, nil
+}
@@ -0,0 +1,295 @@
+package watermark
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// makeTree creates empty files at the given slash-separated paths below dir
+func makeTree(t *testing.T, dir string, paths ...string) {
+	t.Helper()
+	for _, p := range paths {
+		file := filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// symlink creates a symlink, skipping the test where symlinks are not available
+func symlink(t *testing.T, target, link string) {
+	t.Helper()
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("symlinks are not available: %v", err)
+	}
+}
+
+// chdir changes the working directory for the rest of the test
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// newTestBatchProcessor creates a batch processor that logs nothing. The
+// config may be nil when no file is processed.
+func newTestBatchProcessor(t *testing.T, config *Config, options BatchOptions) *BatchProcessor {
+	t.Helper()
+	options.Logger = logrus.New()
+	options.Logger.SetOutput(io.Discard)
+	bp, err := NewBatchProcessor(config, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bp
+}
+
+// relPaths returns files relative to dir with forward slashes, sorted
+func relPaths(t *testing.T, dir string, files []string) []string {
+	t.Helper()
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, filepath.ToSlash(rel))
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+func TestFindImageFiles(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir,
+		"a.jpg",
+		"b.PNG",
+		"notes.txt",
+		"id_front.jpg",
+		"sub/c.jpg",
+		"sub/id_back.png",
+		"sub/deep/d.jpeg",
+		".git/objects/e.jpg",
+	)
+
+	tests := []struct {
+		name    string
+		options BatchOptions
+		want    []string
+	}{
+		{
+			name: "input directory only",
+			want: []string{"a.jpg", "b.PNG", "id_front.jpg"},
+		},
+		{
+			name:    "recursive",
+			options: BatchOptions{Recursive: true},
+			want:    []string{".git/objects/e.jpg", "a.jpg", "b.PNG", "id_front.jpg", "sub/c.jpg", "sub/deep/d.jpeg", "sub/id_back.png"},
+		},
+		{
+			name:    "include matches names",
+			options: BatchOptions{Recursive: true, Include: []string{"id_*"}},
+			want:    []string{"id_front.jpg", "sub/id_back.png"},
+		},
+		{
+			name:    "include with a slash matches paths",
+			options: BatchOptions{Recursive: true, Include: []string{"**/*.jpg"}},
+			want:    []string{".git/objects/e.jpg", "a.jpg", "id_front.jpg", "sub/c.jpg"},
+		},
+		{
+			name:    "include of a subdirectory",
+			options: BatchOptions{Recursive: true, Include: []string{"sub/*"}},
+			want:    []string{"sub/c.jpg", "sub/id_back.png"},
+		},
+		{
+			name:    "exclude matches names",
+			options: BatchOptions{Recursive: true, Exclude: []string{"*.png"}},
+			want:    []string{".git/objects/e.jpg", "a.jpg", "b.PNG", "id_front.jpg", "sub/c.jpg", "sub/deep/d.jpeg"},
+		},
+		{
+			name:    "excluded directory is pruned",
+			options: BatchOptions{Recursive: true, Exclude: []string{".git"}},
+			want:    []string{"a.jpg", "b.PNG", "id_front.jpg", "sub/c.jpg", "sub/deep/d.jpeg", "sub/id_back.png"},
+		},
+		{
+			name:    "excluded nested directory is pruned",
+			options: BatchOptions{Recursive: true, Exclude: []string{"**/deep", ".git"}},
+			want:    []string{"a.jpg", "b.PNG", "id_front.jpg", "sub/c.jpg", "sub/id_back.png"},
+		},
+		{
+			name:    "include and exclude",
+			options: BatchOptions{Recursive: true, Include: []string{"**/*.jpg"}, Exclude: []string{"sub/**", ".git"}},
+			want:    []string{"a.jpg", "id_front.jpg"},
+		},
+		{
+			name:    "max depth",
+			options: BatchOptions{Recursive: true, MaxDepth: 2},
+			want:    []string{"a.jpg", "b.PNG", "id_front.jpg", "sub/c.jpg", "sub/id_back.png"},
+		},
+		{
+			name:    "max depth of the input directory",
+			options: BatchOptions{Recursive: true, MaxDepth: 1},
+			want:    []string{"a.jpg", "b.PNG", "id_front.jpg"},
+		},
+		{
+			name:    "max depth without recursive",
+			options: BatchOptions{MaxDepth: 3},
+			want:    []string{"a.jpg", "b.PNG", "id_front.jpg"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bp := newTestBatchProcessor(t, nil, tt.options)
+			files, err := bp.findImageFiles(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := relPaths(t, dir, files); !slices.Equal(got, tt.want) {
+				t.Errorf("findImageFiles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindImageFilesSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, "real/a.jpg")
+	symlink(t, filepath.Join(dir, "real", "a.jpg"), filepath.Join(dir, "link.jpg"))
+	symlink(t, filepath.Join(dir, "real"), filepath.Join(dir, "linkdir"))
+	symlink(t, dir, filepath.Join(dir, "real", "loop"))
+	symlink(t, filepath.Join(dir, "missing.jpg"), filepath.Join(dir, "broken.jpg"))
+
+	tests := []struct {
+		name    string
+		options BatchOptions
+		want    []string
+	}{
+		{
+			name:    "symlinks skipped",
+			options: BatchOptions{Recursive: true},
+			want:    []string{"real/a.jpg"},
+		},
+		{
+			// The loop back to the input directory is walked once, through
+			// neither real/loop nor linkdir/loop
+			name:    "symlinks followed",
+			options: BatchOptions{Recursive: true, FollowSymlinks: true},
+			want:    []string{"link.jpg", "linkdir/a.jpg", "real/a.jpg"},
+		},
+		{
+			name:    "symlinks followed without recursive",
+			options: BatchOptions{FollowSymlinks: true},
+			want:    []string{"link.jpg"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bp := newTestBatchProcessor(t, nil, tt.options)
+			files, err := bp.findImageFiles(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := relPaths(t, dir, files); !slices.Equal(got, tt.want) {
+				t.Errorf("findImageFiles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListedImageFiles(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, "in/a.jpg", "in/b.png", "in/notes.txt", "in/sub/c.jpg", "in/sub/id_back.png", "outside.jpg")
+	chdir(t, dir)
+
+	tests := []struct {
+		name    string
+		options BatchOptions
+		files   []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			// As printed by find in/ -newer last-run
+			name:  "relative to the working directory",
+			files: []string{"in/a.jpg", "./in/sub/c.jpg", "in/sub/../b.png"},
+			want:  []string{"a.jpg", "b.png", "sub/c.jpg"},
+		},
+		{
+			name:  "absolute path inside",
+			files: []string{filepath.Join(dir, "in", "sub", "id_back.png")},
+			want:  []string{"sub/id_back.png"},
+		},
+		{
+			name:  "listed twice",
+			files: []string{"in/a.jpg", filepath.Join(dir, "in", "a.jpg"), "./in/a.jpg"},
+			want:  []string{"a.jpg"},
+		},
+		{
+			name:  "unsupported file skipped",
+			files: []string{"in/a.jpg", "in/notes.txt"},
+			want:  []string{"a.jpg"},
+		},
+		{
+			name:    "filters apply",
+			options: BatchOptions{Exclude: []string{"*.png"}},
+			files:   []string{"in/a.jpg", "in/b.png"},
+			want:    []string{"a.jpg"},
+		},
+		{
+			// Missing files are kept, so they are reported as failed
+			name:  "missing file kept",
+			files: []string{"in/a.jpg", "in/missing.jpg"},
+			want:  []string{"a.jpg", "missing.jpg"},
+		},
+		{
+			name:    "relative path outside",
+			files:   []string{"in/a.jpg", "outside.jpg"},
+			wantErr: true,
+		},
+		{
+			name:    "relative path leaving through a subdirectory",
+			files:   []string{"in/sub/../../outside.jpg"},
+			wantErr: true,
+		},
+		{
+			name:    "absolute path outside",
+			files:   []string{filepath.Join(dir, "outside.jpg")},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bp := newTestBatchProcessor(t, nil, tt.options)
+			files, err := bp.listedImageFiles("in", tt.files)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("listedImageFiles(%v) = %v, want an error", tt.files, files)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := relPaths(t, "in", files); !slices.Equal(got, tt.want) {
+				t.Errorf("listedImageFiles(%v) = %v, want %v", tt.files, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,443 @@
+package watermark
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultSettle is how long a file must stay unchanged before watch mode
+// processes it
+const DefaultSettle = 2 * time.Second
+
+// WatchOptions configures watching a directory
+type WatchOptions struct {
+	// Settle is how long a file must keep its size and modification time
+	// before it is processed, so files still being written are left alone
+	Settle time.Duration
+	// Poll rescans the input directory at this interval, for file systems
+	// such as network mounts that do not report every change. Zero only
+	// scans it at the start.
+	Poll time.Duration
+	// ArchiveDir receives the originals of processed files, at the same path
+	// relative to it as to the input directory. A later file at the path of
+	// an archived one gets a numbered output rather than replacing its
+	// output. When empty, originals are left in place.
+	ArchiveDir string
+}
+
+// fileStamp identifies a version of a file
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// statFile returns the stamp of a regular file
+func statFile(path string) (fileStamp, bool) {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return fileStamp{}, false
+	}
+	return fileStamp{size: info.Size(), modTime: info.ModTime()}, true
+}
+
+// pendingFile is a file waiting to settle
+type pendingFile struct {
+	stamp fileStamp
+	since time.Time
+}
+
+// watch is the state of a watched directory
+type watch struct {
+	bp        *BatchProcessor
+	inputDir  string
+	outputDir string
+	options   WatchOptions
+	watcher   *fsnotify.Watcher
+	namer     *outputNamer
+	state     *batchState
+	// ignored are directories inside the input directory that are written
+	// to, such as the output directory, so outputs are not processed again
+	ignored []string
+
+	pending map[string]pendingFile
+	// done are the stamps of the files processed or failed, so rescans only
+	// pick up files that changed since
+	done map[string]fileStamp
+}
+
+// Watch processes the image files of a directory as they are added or
+// changed, until ctx is cancelled. Files already in the directory are
+// processed first. Files are processed once they have settled, with the
+// settings, names and state file of ProcessDirectory. Failures are logged
+// and do not stop the watch.
+//
+// Settled files are processed on the goroutine that receives the file
+// system events, so events that arrive meanwhile wait in the queue of the
+// watcher. When a large batch lets the queue overflow, the watcher reports
+// an error and the directory is rescanned, so lost events only delay files
+// until the batch is done.
+func (bp *BatchProcessor) Watch(ctx context.Context, inputDir, outputDir string, options WatchOptions) error {
+	w, err := bp.newWatch(inputDir, outputDir, options)
+	if err != nil {
+		return err
+	}
+	defer w.close()
+
+	w.scan()
+
+	ticker := time.NewTicker(max(w.options.Settle/4, 100*time.Millisecond))
+	defer ticker.Stop()
+	lastScan := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return nil
+			}
+			w.handle(event)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return nil
+			}
+			// Events may have been lost, such as when the queue overflowed
+			bp.logger.WithError(err).Warn("Watch error, rescanning")
+			w.scan()
+		case now := <-ticker.C:
+			if w.options.Poll > 0 && now.Sub(lastScan) >= w.options.Poll {
+				w.scan()
+				lastScan = now
+			}
+			w.processSettled(ctx, now)
+		}
+	}
+}
+
+// newWatch creates the output and archive directories, starts watching the
+// input directory and loads the state file. The watch must be closed.
+func (bp *BatchProcessor) newWatch(inputDir, outputDir string, options WatchOptions) (*watch, error) {
+	if bp.processor == nil {
+		return nil, fmt.Errorf("watching a directory requires a config")
+	}
+	if options.Settle <= 0 {
+		options.Settle = DefaultSettle
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("creating output directory: %w", err)
+	}
+	if options.ArchiveDir != "" {
+		if err := os.MkdirAll(options.ArchiveDir, 0755); err != nil {
+			return nil, fmt.Errorf("creating archive directory: %w", err)
+		}
+	}
+
+	// The options were validated when the batch processor was created
+	namer, _ := newOutputNamer(bp.nameTemplate, bp.layout, bp.format)
+	if options.ArchiveDir != "" {
+		// Archived inputs are gone, so a new file with the same path is
+		// another input, whose output must not replace theirs
+		namer.existingDir = outputDir
+	}
+
+	w := &watch{
+		bp:        bp,
+		inputDir:  inputDir,
+		outputDir: outputDir,
+		options:   options,
+		namer:     namer,
+		pending:   make(map[string]pendingFile),
+		done:      make(map[string]fileStamp),
+	}
+	for _, dir := range []string{outputDir, options.ArchiveDir} {
+		if dir == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(dir); err == nil {
+			w.ignored = append(w.ignored, abs)
+		}
+	}
+
+	if w.isIgnored(inputDir) {
+		return nil, fmt.Errorf("the input directory cannot be inside the output or archive directory")
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("creating watcher: %w", err)
+	}
+	w.watcher = watcher
+	if err := w.addDir(inputDir); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("watching %s: %w", inputDir, err)
+	}
+
+	// Files processed before with the same settings are skipped
+	if w.state, err = loadState(outputDir); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// close stops watching and rewrites the state file
+func (w *watch) close() {
+	w.watcher.Close()
+	if err := w.state.close(); err != nil {
+		w.bp.logger.WithError(err).Warn("Failed to update state file")
+	}
+}
+
+// isIgnored reports whether a path is inside a directory that is written to
+func (w *watch) isIgnored(p string) bool {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return false
+	}
+	for _, dir := range w.ignored {
+		if abs == dir || strings.HasPrefix(abs, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// relPath returns a path relative to the input directory, with forward slashes
+func (w *watch) relPath(p string) string {
+	rel, err := filepath.Rel(w.inputDir, p)
+	if err != nil {
+		return filepath.Base(p)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// descends reports whether the files of a subdirectory are watched
+func (w *watch) descends(dir string) bool {
+	if !w.bp.recursive || w.isIgnored(dir) {
+		return false
+	}
+	rel := w.relPath(dir)
+	if w.bp.filter.excludesDir(rel) {
+		return false
+	}
+	return w.bp.maxDepth == 0 || strings.Count(rel, "/")+1 < w.bp.maxDepth
+}
+
+// addDir watches a directory, and its subdirectories when recursive
+func (w *watch) addDir(dir string) error {
+	if err := w.watcher.Add(dir); err != nil {
+		return err
+	}
+	if !w.bp.recursive {
+		return nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		sub := filepath.Join(dir, entry.Name())
+		if entry.Type()&os.ModeSymlink != 0 && !w.bp.followSymlinks {
+			continue
+		}
+		if info, err := os.Stat(sub); err != nil || !info.IsDir() || !w.descends(sub) {
+			continue
+		}
+		if err := w.addDir(sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan adds the files of the input directory that are new or changed since
+// they were processed
+func (w *watch) scan() {
+	files, err := w.bp.findImageFiles(w.inputDir)
+	if err != nil {
+		w.bp.logger.WithError(err).Warn("Failed to scan input directory")
+		return
+	}
+	for _, file := range files {
+		if !w.isIgnored(file) {
+			w.add(file)
+		}
+	}
+}
+
+// add starts waiting for a file to settle, unless it is already waiting or
+// was processed as it is
+func (w *watch) add(file string) {
+	if _, ok := w.pending[file]; ok {
+		return
+	}
+	stamp, ok := statFile(file)
+	if !ok {
+		return
+	}
+	if done, ok := w.done[file]; ok && done == stamp {
+		return
+	}
+	w.pending[file] = pendingFile{stamp: stamp, since: time.Now()}
+}
+
+// handle updates the pending files from a file system event
+func (w *watch) handle(event fsnotify.Event) {
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		delete(w.pending, event.Name)
+		return
+	}
+	if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+		return
+	}
+	if w.isIgnored(event.Name) {
+		return
+	}
+
+	info, err := os.Lstat(event.Name)
+	if err != nil {
+		return
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if !w.bp.followSymlinks {
+			return
+		}
+		if info, err = os.Stat(event.Name); err != nil {
+			return
+		}
+	}
+
+	if info.IsDir() {
+		// Files may have landed in a new directory before it was watched
+		if event.Has(fsnotify.Create) && w.descends(event.Name) {
+			if err := w.addDir(event.Name); err != nil {
+				w.bp.logger.WithError(err).WithField("dir", event.Name).Warn("Failed to watch directory")
+			}
+			w.scan()
+		}
+		return
+	}
+	if w.bp.filter.selects(w.relPath(event.Name)) {
+		w.add(event.Name)
+	}
+}
+
+// processSettled processes the pending files that stayed unchanged for the
+// settle time, then archives the originals. It returns once they are all
+// processed, and events are not handled meanwhile, see Watch.
+func (w *watch) processSettled(ctx context.Context, now time.Time) {
+	var ready []string
+	for file, pending := range w.pending {
+		stamp, ok := statFile(file)
+		switch {
+		case !ok:
+			delete(w.pending, file)
+		case stamp != pending.stamp:
+			w.pending[file] = pendingFile{stamp: stamp, since: now}
+		case now.Sub(pending.since) >= w.options.Settle:
+			ready = append(ready, file)
+			delete(w.pending, file)
+			w.done[file] = stamp
+		}
+	}
+	if len(ready) == 0 {
+		return
+	}
+	sort.Strings(ready)
+
+	// Directory config files and the date in names may have changed
+	w.bp.dirs = make(map[string]*dirSettings)
+	w.namer.date = now.Format("2006-01-02")
+
+	result := w.bp.processFiles(ctx, w.namer, ready, w.inputDir, w.outputDir, w.state)
+	for _, file := range result.Files {
+		w.bp.logger.WithFields(logrus.Fields{
+			"file":   file.InputPath,
+			"output": file.OutputPath,
+		}).Info("Watermarked image")
+	}
+
+	if w.options.ArchiveDir == "" {
+		return
+	}
+	archived := result.Skipped
+	for _, file := range result.Files {
+		archived = append(archived, file.InputPath)
+	}
+	for _, file := range archived {
+		dest, err := w.archive(file)
+		if err != nil {
+			w.bp.logger.WithError(err).WithField("file", file).Error("Failed to archive image")
+			continue
+		}
+		delete(w.done, file)
+		w.namer.release(w.relPath(file))
+		w.bp.logger.WithField("file", file).WithField("archive", dest).Debug("Archived image")
+	}
+}
+
+// archive moves an original to the archive directory, numbering its name
+// when an earlier file was archived with the same name
+func (w *watch) archive(file string) (string, error) {
+	rel := filepath.FromSlash(w.relPath(file))
+	dest := filepath.Join(w.options.ArchiveDir, rel)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", fmt.Errorf("creating archive directory: %w", err)
+	}
+
+	ext := filepath.Ext(dest)
+	stem := strings.TrimSuffix(dest, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(dest); os.IsNotExist(err) {
+			break
+		}
+		dest = fmt.Sprintf("%s_%d%s", stem, i, ext)
+	}
+
+	if err := os.Rename(file, dest); err != nil {
+		// Renaming fails across file systems, such as from a network mount
+		if copyErr := copyFile(file, dest); copyErr != nil {
+			return "", fmt.Errorf("moving to archive: %w", err)
+		}
+		if err := os.Remove(file); err != nil {
+			return "", fmt.Errorf("removing archived original: %w", err)
+		}
+	}
+	return dest, nil
+}
+
+// copyFile copies a file, removing the copy when it fails
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dest)
+		return err
+	}
+	return nil
+}
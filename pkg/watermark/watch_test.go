@@ -0,0 +1,209 @@
+package watermark
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// newTestWatch starts a watch of inputDir without its event loop, so tests
+// drive it by calling scan, handle and processSettled. Times passed to
+// processSettled are relative to the settle time of an hour, so the clock
+// does not matter.
+func newTestWatch(t *testing.T, inputDir, outputDir string, options BatchOptions, archiveDir string) *watch {
+	t.Helper()
+	bp := newTestBatchProcessor(t, testConfig(t), options)
+	w, err := bp.newWatch(inputDir, outputDir, WatchOptions{Settle: time.Hour, ArchiveDir: archiveDir})
+	if err != nil {
+		t.Fatalf("newWatch() error = %v", err)
+	}
+	t.Cleanup(w.close)
+	return w
+}
+
+// pendingPaths returns the pending files of a watch relative to dir
+func pendingPaths(t *testing.T, w *watch, dir string) []string {
+	t.Helper()
+	files := make([]string, 0, len(w.pending))
+	for file := range w.pending {
+		files = append(files, file)
+	}
+	return relPaths(t, dir, files)
+}
+
+// outputPaths returns the files of dir other than the state file, relative
+// to it with forward slashes
+func outputPaths(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && d.Name() != StateFile {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return relPaths(t, dir, files)
+}
+
+func TestWatchSettle(t *testing.T) {
+	inputDir, outputDir := t.TempDir(), t.TempDir()
+	writeImages(t, inputDir, "a.png", "b.png")
+	w := newTestWatch(t, inputDir, outputDir, BatchOptions{}, "")
+	ctx := context.Background()
+	start := time.Now()
+
+	w.scan()
+	if got, want := pendingPaths(t, w, inputDir), []string{"a.png", "b.png"}; !slices.Equal(got, want) {
+		t.Fatalf("pending after scan = %v, want %v", got, want)
+	}
+
+	// b.png is still being written when it is checked, so it waits for the
+	// settle time again
+	appendFile(t, filepath.Join(inputDir, "b.png"), "more data")
+	w.processSettled(ctx, start.Add(30*time.Minute))
+	if got := outputPaths(t, outputDir); len(got) != 0 {
+		t.Fatalf("outputs before the settle time = %v, want none", got)
+	}
+
+	w.processSettled(ctx, start.Add(61*time.Minute))
+	if got, want := outputPaths(t, outputDir), []string{"a.png"}; !slices.Equal(got, want) {
+		t.Errorf("outputs once a.png settled = %v, want %v", got, want)
+	}
+	if got, want := pendingPaths(t, w, inputDir), []string{"b.png"}; !slices.Equal(got, want) {
+		t.Errorf("pending once a.png settled = %v, want %v", got, want)
+	}
+
+	w.processSettled(ctx, start.Add(91*time.Minute))
+	if got, want := outputPaths(t, outputDir), []string{"a.png", "b.png"}; !slices.Equal(got, want) {
+		t.Errorf("outputs once b.png settled = %v, want %v", got, want)
+	}
+
+	// A file removed before it settles is dropped
+	writeImages(t, inputDir, "c.png")
+	w.scan()
+	if err := os.Remove(filepath.Join(inputDir, "c.png")); err != nil {
+		t.Fatal(err)
+	}
+	w.processSettled(ctx, start.Add(200*time.Minute))
+	if len(w.pending) != 0 {
+		t.Errorf("pending after removal = %v, want none", pendingPaths(t, w, inputDir))
+	}
+}
+
+func TestWatchRescan(t *testing.T) {
+	inputDir, outputDir := t.TempDir(), t.TempDir()
+	writeImages(t, inputDir, "a.png", "b.png")
+	w := newTestWatch(t, inputDir, outputDir, BatchOptions{}, "")
+
+	w.scan()
+	w.processSettled(context.Background(), time.Now().Add(2*time.Hour))
+
+	tests := []struct {
+		name   string
+		change func(t *testing.T)
+		want   []string
+	}{
+		{name: "unchanged files", want: []string{}},
+		{
+			name:   "changed file",
+			change: func(t *testing.T) { appendFile(t, filepath.Join(inputDir, "a.png"), "more data") },
+			want:   []string{"a.png"},
+		},
+		{
+			name:   "new file",
+			change: func(t *testing.T) { writeImages(t, inputDir, "c.png") },
+			want:   []string{"a.png", "c.png"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.change != nil {
+				tt.change(t)
+			}
+			w.scan()
+			if got := pendingPaths(t, w, inputDir); !slices.Equal(got, tt.want) {
+				t.Errorf("pending after rescan = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatchIgnoredDirs(t *testing.T) {
+	inputDir := t.TempDir()
+	outputDir, archiveDir := filepath.Join(inputDir, "out"), filepath.Join(inputDir, "archive")
+	writeImages(t, inputDir, "a.png", "sub/b.png", "out/old.png", "archive/old.png")
+	w := newTestWatch(t, inputDir, outputDir, BatchOptions{Recursive: true}, archiveDir)
+
+	w.scan()
+	if got, want := pendingPaths(t, w, inputDir), []string{"a.png", "sub/b.png"}; !slices.Equal(got, want) {
+		t.Errorf("pending after scan = %v, want %v", got, want)
+	}
+
+	writeImages(t, inputDir, "out/new.png", "archive/new.png", "sub/c.png")
+	for _, name := range []string{"out/new.png", "archive/new.png", "sub/c.png"} {
+		w.handle(fsnotify.Event{Name: filepath.Join(inputDir, filepath.FromSlash(name)), Op: fsnotify.Create})
+	}
+	if got, want := pendingPaths(t, w, inputDir), []string{"a.png", "sub/b.png", "sub/c.png"}; !slices.Equal(got, want) {
+		t.Errorf("pending after events = %v, want %v", got, want)
+	}
+
+	bp := newTestBatchProcessor(t, testConfig(t), BatchOptions{})
+	if _, err := bp.newWatch(filepath.Join(outputDir, "in"), outputDir, WatchOptions{}); err == nil {
+		t.Error("newWatch() of a directory inside the output directory succeeded, want an error")
+	}
+}
+
+func TestWatchArchive(t *testing.T) {
+	inputDir, outputDir, archiveDir := t.TempDir(), t.TempDir(), t.TempDir()
+	w := newTestWatch(t, inputDir, outputDir, BatchOptions{Recursive: true}, archiveDir)
+	now := time.Now()
+
+	// Every version of a file at the same path gets an output and an
+	// archived original of its own
+	for i, want := range [][]string{
+		{"sub/a.png"},
+		{"sub/a.png", "sub/a_1.png"},
+		{"sub/a.png", "sub/a_1.png", "sub/a_2.png"},
+	} {
+		writeImages(t, inputDir, "sub/a.png")
+		w.scan()
+		now = now.Add(2 * time.Hour)
+		w.processSettled(context.Background(), now)
+
+		if got := outputPaths(t, outputDir); !slices.Equal(got, want) {
+			t.Errorf("run %d: outputs = %v, want %v", i+1, got, want)
+		}
+		if got := outputPaths(t, archiveDir); !slices.Equal(got, want) {
+			t.Errorf("run %d: archive = %v, want %v", i+1, got, want)
+		}
+		if _, err := os.Stat(filepath.Join(inputDir, "sub", "a.png")); !os.IsNotExist(err) {
+			t.Errorf("run %d: original left in the input directory: %v", i+1, err)
+		}
+	}
+}
+
+// appendFile appends data to a file, which changes its stamp but, after
+// the end of a PNG, not its image
+func appendFile(t *testing.T, path, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,37 +3,128 @@ package watermark
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"math"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"golang.org/x/image/draw"
 	"golang.org/x/image/font/opentype"
-	"gonum.org/v1/plot"
-	"gonum.org/v1/plot/font"
 	"gonum.org/v1/plot/vg"
 	"gonum.org/v1/plot/vg/vgimg"
 )
 
+// DefaultTextTemplate is the watermark text used when no template is configured
+const DefaultTextTemplate = "{company} - {date}"
+
 // Config holds the configuration for watermark application
 type Config struct {
 	CompanyName    string
 	Timestamp      time.Time
-	FontSize       float64
+	TextTemplate   string
+	FontSize       Length
 	Opacity        uint8
 	Angle          float64
 	Font           *opentype.Font
-	TextSpacing    float64
-	LineSpacing    float64
+	TextSpacing    Length
+	LineSpacing    Length
 	Quality        int
 	WatermarkColor color.RGBA
+
+	// StrokeColor outlines the watermark text, and BackgroundColor fills a
+	// band behind each line of it. Colors with a zero alpha are not drawn.
+	StrokeColor     color.RGBA
+	BackgroundColor color.RGBA
+
+	// Purpose states what the document is shared for
+	Purpose string
+	// Recipient states who the document is shared with
+	Recipient string
+
+	// ForensicMark adds an identifier unique to every output to the text, so
+	// a leaked copy can be traced back to the file it was made for
+	ForensicMark bool
+	// Mark is the identifier of the output being processed
+	Mark string
+
+	// MinDensity is the smallest fraction of the image the watermark text
+	// may cover, see Density. Zero disables the check.
+	MinDensity float64
+
+	// FallbackFonts are tried in order for characters the main font lacks
+	FallbackFonts []*opentype.Font
+
+	// DetectDocument crops the image to the detected document outline and
+	// corrects its perspective before the watermark is applied. Images where
+	// no outline is found are watermarked whole.
+	DetectDocument bool
+	// DebugOutline saves a copy of the input with the detected outline drawn
+	// on it next to the output file
+	DebugOutline bool
+
+	// Redactions are obscured before the watermark is applied
+	Redactions []Redaction
+
+	// MaxDimension limits the longest side of the output in pixels
+	MaxDimension int
+	// TargetDPI limits the output resolution when the input resolution is known
+	TargetDPI float64
+
+	// Fingerprint identifies the settings the config was created from. Batch
+	// processing skips files already processed with the same fingerprint;
+	// files with an empty fingerprint are always processed.
+	Fingerprint string
+}
+
+// Text returns the watermark text drawn on every image, expanding the
+// {company}, {date}, {purpose}, {recipient} and {mark} placeholders of the
+// text template. A purpose, recipient or forensic mark is appended when the
+// template has no placeholder for it, so it is always shown.
+func (c *Config) Text() string {
+	template := c.TextTemplate
+	if template == "" {
+		template = DefaultTextTemplate
+	}
+	if c.Purpose != "" && !strings.Contains(template, "{purpose}") {
+		template += " - {purpose}"
+	}
+	if c.Recipient != "" && !strings.Contains(template, "{recipient}") {
+		template += " - for {recipient}"
+	}
+	if c.ForensicMark && !strings.Contains(template, "{mark}") {
+		template += " #{mark}"
+	}
+
+	mark := c.Mark
+	if c.ForensicMark && mark == "" {
+		mark = markPlaceholder
+	}
+
+	return strings.NewReplacer(
+		"{company}", c.CompanyName,
+		"{date}", c.Timestamp.Format("2006-01-02"),
+		"{purpose}", c.Purpose,
+		"{recipient}", c.Recipient,
+		"{mark}", mark,
+	).Replace(template)
+}
+
+// DisplayText returns the watermark text shaped and in visual order, ready
+// to be drawn glyph by glyph from left to right
+func (c *Config) DisplayText() string {
+	return reorderBidi(shapeArabic(c.Text()))
 }
 
 // Processor handles image watermarking operations
@@ -49,42 +140,216 @@ func NewProcessor(config *Config) *Processor {
 	return &Processor{config: config}
 }
 
+// FileResult describes a successfully processed image file
+type FileResult struct {
+	InputPath    string
+	OutputPath   string
+	OriginalSize image.Point
+	FinalSize    image.Point
+
+	// InputHash and OutputHash are hex-encoded SHA-256 hashes of the files
+	InputHash  string
+	OutputHash string
+	// InputFormat and OutputFormat are "jpeg" or "png"
+	InputFormat  string
+	OutputFormat string
+	// Duration is how long processing took
+	Duration time.Duration
+	// Params are the effective watermark parameters
+	Params Params
+
+	// Mark is the forensic mark drawn on the output, if enabled
+	Mark string
+	// Overrides are the directory config files that applied, outermost first
+	Overrides []string
+}
+
 // ProcessFile applies watermark to a single image file
-func (p *Processor) ProcessFile(inputPath, outputPath string) error {
-	// Open and decode input image
-	inputFile, err := os.Open(inputPath)
+func (p *Processor) ProcessFile(ctx context.Context, inputPath, outputPath string) error {
+	_, err := p.Process(ctx, inputPath, outputPath)
+	return err
+}
+
+// Process applies watermark to a single image file and describes the
+// result. Errors are classified by the stage that failed, see ClassOf.
+// Cancelling ctx stops processing between stages; the output is written to
+// a temporary file renamed into place, so it is never left half-written.
+func (p *Processor) Process(ctx context.Context, inputPath, outputPath string) (*FileResult, error) {
+	start := time.Now()
+
+	p, err := p.withMark()
+	if err != nil {
+		return nil, classify(ErrorClassProcessing, err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Read input image
+	data, err := os.ReadFile(inputPath)
 	if err != nil {
-		return fmt.Errorf("opening input file: %w", err)
+		return nil, classify(ErrorClassInput, fmt.Errorf("reading input file: %w", err))
 	}
-	defer inputFile.Close()
 
 	// Detect and decode image format
-	inputImage, err := p.decodeImage(inputFile, inputPath)
+	inputImage, err := p.decodeImage(bytes.NewReader(data), inputPath)
 	if err != nil {
-		return fmt.Errorf("decoding image: %w", err)
+		return nil, classify(ErrorClassInput, fmt.Errorf("decoding image: %w", err))
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Crop, redact and resize
+	preparedImage, dpi, err := p.prepareImage(inputImage, readDPI(data), outputPath)
+	if err != nil {
+		return nil, classify(ErrorClassProcessing, err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
 	// Apply watermark
-	watermarkedImage, err := p.applyWatermark(inputImage)
+	watermarkedImage, err := p.applyWatermark(preparedImage, dpi)
 	if err != nil {
-		return fmt.Errorf("applying watermark: %w", err)
+		return nil, classify(ErrorClassProcessing, fmt.Errorf("applying watermark: %w", err))
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
 	// Save output image
-	if err := p.saveImage(watermarkedImage, outputPath); err != nil {
-		return fmt.Errorf("saving image: %w", err)
+	outputHash, err := p.saveImage(watermarkedImage, outputPath)
+	if err != nil {
+		return nil, classify(ErrorClassOutput, fmt.Errorf("saving image: %w", err))
 	}
 
-	return nil
+	return &FileResult{
+		InputPath:    inputPath,
+		OutputPath:   outputPath,
+		OriginalSize: inputImage.Bounds().Size(),
+		FinalSize:    watermarkedImage.Bounds().Size(),
+		InputHash:    hashBytes(data),
+		OutputHash:   outputHash,
+		InputFormat:  imageFormat(inputPath),
+		OutputFormat: imageFormat(outputPath),
+		Duration:     time.Since(start),
+		Params:       p.config.params(),
+		Mark:         p.config.Mark,
+	}, nil
 }
 
 // ProcessImage applies watermark to an image.Image and returns the result
 func (p *Processor) ProcessImage(img image.Image) (image.Image, error) {
-	return p.applyWatermark(img)
+	p, err := p.withMark()
+	if err != nil {
+		return nil, err
+	}
+
+	prepared, dpi, err := p.prepareImage(img, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	return p.applyWatermark(prepared, dpi)
+}
+
+// prepareImage runs the pre-processing stages that come before watermarking:
+// document detection, redaction and downscaling. dpi is the resolution of the
+// input, or 0 when unknown, and the resolution of the result is returned.
+func (p *Processor) prepareImage(img image.Image, dpi float64, outputPath string) (image.Image, float64, error) {
+	// Crop to the document if requested. Detection is best effort, so an
+	// image without a document outline is watermarked whole.
+	if p.config.DetectDocument {
+		cropped, err := p.detectDocument(img, outputPath)
+		switch {
+		case errors.Is(err, ErrNoDocument):
+			entry := logrus.WithError(err)
+			if outputPath != "" {
+				entry = entry.WithField("output", outputPath)
+			}
+			entry.Warn("No document found, watermarking the whole image")
+		case err != nil:
+			return nil, 0, fmt.Errorf("detecting document: %w", err)
+		default:
+			img = cropped
+		}
+	}
+
+	// Obscure redacted regions
+	if len(p.config.Redactions) > 0 {
+		img = applyRedactions(img, p.config.Redactions)
+	}
+
+	// Downscale so the watermark is drawn at the final resolution
+	img, dpi = p.downscale(img, dpi)
+
+	return img, dpi, nil
 }
 
-// decodeImage decodes an image from a file based on its extension
-func (p *Processor) decodeImage(file *os.File, filename string) (image.Image, error) {
+// downscale resamples the image so that it fits within MaxDimension and does
+// not exceed TargetDPI. Images are never upscaled, and TargetDPI is ignored
+// when the input resolution is unknown. The resolution of the result is returned.
+func (p *Processor) downscale(img image.Image, dpi float64) (image.Image, float64) {
+	bounds := img.Bounds()
+	scale := 1.0
+
+	if p.config.MaxDimension > 0 {
+		if longest := max(bounds.Dx(), bounds.Dy()); longest > p.config.MaxDimension {
+			scale = math.Min(scale, float64(p.config.MaxDimension)/float64(longest))
+		}
+	}
+
+	if p.config.TargetDPI > 0 && dpi > p.config.TargetDPI {
+		scale = math.Min(scale, p.config.TargetDPI/dpi)
+	}
+
+	if scale >= 1 {
+		return img, dpi
+	}
+
+	w := max(1, int(math.Round(float64(bounds.Dx())*scale)))
+	h := max(1, int(math.Round(float64(bounds.Dy())*scale)))
+	result := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(result, result.Bounds(), img, bounds, draw.Src, nil)
+
+	return result, dpi * scale
+}
+
+// detectDocument crops the image to the detected document, saving the debug
+// outline next to outputPath when enabled. When no document is found, the
+// debug outline shows the edge map and the largest contour instead.
+func (p *Processor) detectDocument(img image.Image, outputPath string) (image.Image, error) {
+	d, detectErr := detect(img)
+
+	if p.config.DebugOutline && outputPath != "" {
+		red := color.RGBA{R: 255, A: 255}
+		outline := DrawOutline(img, d.quad, red)
+		if detectErr != nil {
+			outline = drawFailedDetection(img, d, red)
+		}
+		if _, err := p.saveImage(outline, debugOutlinePath(outputPath)); err != nil {
+			return nil, fmt.Errorf("saving debug outline: %w", err)
+		}
+	}
+
+	if detectErr != nil {
+		return nil, detectErr
+	}
+	return WarpDocument(img, d.quad), nil
+}
+
+// debugOutlinePath returns the path of the debug outline image for an output file
+func debugOutlinePath(outputPath string) string {
+	ext := filepath.Ext(outputPath)
+	return strings.TrimSuffix(outputPath, ext) + "_outline" + ext
+}
+
+// decodeImage decodes an image from a reader based on the file extension
+func (p *Processor) decodeImage(file io.Reader, filename string) (image.Image, error) {
 	ext := strings.ToLower(filepath.Ext(filename))
 
 	switch ext {
@@ -97,29 +362,76 @@ func (p *Processor) decodeImage(file *os.File, filename string) (image.Image, er
 	}
 }
 
-// saveImage saves an image to a file based on the output path extension
-func (p *Processor) saveImage(img image.Image, outputPath string) error {
-	outputFile, err := os.Create(outputPath)
+// saveImage saves an image to a file based on the output path extension and
+// returns the hex-encoded SHA-256 hash of the file. The image is written to
+// a temporary file in the same directory that is renamed into place once
+// complete and synced, so an interrupted write or a crash never leaves a
+// truncated output.
+func (p *Processor) saveImage(img image.Image, outputPath string) (string, error) {
+	ext := strings.ToLower(filepath.Ext(outputPath))
+	if ext != ".png" && ext != ".jpg" && ext != ".jpeg" {
+		return "", fmt.Errorf("unsupported output format: %s (supported: .jpg, .jpeg, .png)", ext)
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(outputPath), "."+filepath.Base(outputPath)+".*.tmp")
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer outputFile.Close()
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+	defer tmpFile.Close()
 
-	ext := strings.ToLower(filepath.Ext(outputPath))
+	hash := sha256.New()
+	w := io.MultiWriter(tmpFile, hash)
 
-	switch ext {
-	case ".png":
-		return png.Encode(outputFile, img)
-	case ".jpg", ".jpeg":
-		return jpeg.Encode(outputFile, img, &jpeg.Options{Quality: p.config.Quality})
-	default:
-		return fmt.Errorf("unsupported output format: %s (supported: .jpg, .jpeg, .png)", ext)
+	if ext == ".png" {
+		err = png.Encode(w, img)
+	} else {
+		err = jpeg.Encode(w, img, &jpeg.Options{Quality: p.config.Quality})
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Temporary files are created private, outputs get the usual permissions
+	if err := tmpFile.Chmod(0644); err != nil {
+		return "", err
+	}
+	// Flush the data to disk before the rename, or a crash could leave the
+	// renamed output empty
+	if err := tmpFile.Sync(); err != nil {
+		return "", err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpPath, outputPath); err != nil {
+		return "", err
 	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-// applyWatermark applies the watermark to an image
-func (p *Processor) applyWatermark(img image.Image) (image.Image, error) {
+// applyWatermark applies the watermark to an image. Relative font size and
+// spacing are resolved against this image, dpi is 0 when unknown.
+func (p *Processor) applyWatermark(img image.Image, dpi float64) (image.Image, error) {
 	bounds := img.Bounds()
+	fontSize, err := p.config.FontSize.resolve(bounds.Size(), dpi)
+	if err != nil {
+		return nil, fmt.Errorf("resolving font size: %w", err)
+	}
+	xDistance, err := p.config.TextSpacing.resolve(bounds.Size(), dpi)
+	if err != nil {
+		return nil, fmt.Errorf("resolving text spacing: %w", err)
+	}
+	yDistance, err := p.config.LineSpacing.resolve(bounds.Size(), dpi)
+	if err != nil {
+		return nil, fmt.Errorf("resolving line spacing: %w", err)
+	}
+	if fontSize < 1 {
+		return nil, fmt.Errorf("font size %s is too small for a %dx%d image", p.config.FontSize, bounds.Dx(), bounds.Dy())
+	}
+
 	w := vg.Length(bounds.Max.X) * vg.Inch / vgimg.DefaultDPI
 	h := vg.Length(bounds.Max.Y) * vg.Inch / vgimg.DefaultDPI
 	diagonal := vg.Length(math.Sqrt(float64(w*w + h*h)))
@@ -134,36 +446,38 @@ func (p *Processor) applyWatermark(img image.Image) (image.Image, error) {
 	}
 	c.DrawImage(rect, img)
 
-	// Configure font
-	fontConfig := font.Font{
-		Typeface: "WatermarkFont",
-		Size:     vg.Length(p.config.FontSize),
-	}
-
-	fontFace := font.Face{
-		Font: fontConfig,
-		Face: p.config.Font,
-	}
-
-	plot.DefaultFont = fontConfig
-	c.SetColor(p.config.WatermarkColor)
-
-	// Create watermark text
-	watermarkText := fmt.Sprintf("%s - %s",
-		p.config.CompanyName,
-		p.config.Timestamp.Format("2006-01-02"))
+	// Lay out watermark text, falling back to other fonts for missing glyphs
+	text := layoutText(p.config.fontChain(), p.config.DisplayText(), fontSize)
 
 	// Apply repeating watermark pattern
-	lineHeight := vg.Length(p.config.FontSize)
-	textWidth := fontFace.Width(watermarkText)
-	xDistance := vg.Length(p.config.TextSpacing)
-	yDistance := vg.Length(p.config.LineSpacing)
+	lineHeight := fontSize
+	textWidth := text.width
+	strokeWidth := max(fontSize/25, 0.5)
+
+	if p.config.MinDensity > 0 {
+		if d := density(textWidth, fontSize, xDistance, yDistance); d < p.config.MinDensity {
+			return nil, fmt.Errorf("watermark density %.2f is below the required minimum of %.2f, use a larger size or smaller spacing", d, p.config.MinDensity)
+		}
+	}
 
 	line := 0
 	for offset := -2 * diagonal; offset < 2*diagonal; offset += lineHeight + yDistance {
 		line++
+
+		// The band covers descenders below the baseline and the full ascent above it
+		if p.config.BackgroundColor.A > 0 {
+			c.SetColor(p.config.BackgroundColor)
+			c.Fill(bandPath(0, diagonal, offset-fontSize*0.3, offset+fontSize))
+		}
+
 		for xOffset := -vg.Length(line) * 1.5 * textWidth; xOffset < w; xOffset += textWidth + xDistance {
-			c.FillString(fontFace, vg.Point{X: xOffset, Y: offset}, watermarkText)
+			pt := vg.Point{X: xOffset, Y: offset}
+			if p.config.StrokeColor.A > 0 {
+				c.SetColor(p.config.StrokeColor)
+				text.stroke(c, pt, strokeWidth)
+			}
+			c.SetColor(p.config.WatermarkColor)
+			text.draw(c, pt)
 		}
 	}
 
@@ -197,19 +511,19 @@ func ValidateConfig(config *Config) error {
 	}
 
 	if strings.TrimSpace(config.CompanyName) == "" {
-		return fmt.Errorf("company name cannot be empty")
+		return fmt.Errorf("company name cannot be empty, set it with --company or the company setting")
 	}
 
-	if config.FontSize < 10 || config.FontSize > 200 {
-		return fmt.Errorf("font size must be between 10 and 200, got: %.1f", config.FontSize)
+	if err := config.FontSize.Validate("font size", 10, 200); err != nil {
+		return err
 	}
 
-	if config.TextSpacing < 5 || config.TextSpacing > 200 {
-		return fmt.Errorf("text spacing must be between 5 and 200, got: %.1f", config.TextSpacing)
+	if err := config.TextSpacing.Validate("text spacing", 5, 200); err != nil {
+		return err
 	}
 
-	if config.LineSpacing < 5 || config.LineSpacing > 200 {
-		return fmt.Errorf("line spacing must be between 5 and 200, got: %.1f", config.LineSpacing)
+	if err := config.LineSpacing.Validate("line spacing", 5, 200); err != nil {
+		return err
 	}
 
 	if config.Quality < 1 || config.Quality > 100 {
@@ -220,5 +534,33 @@ func ValidateConfig(config *Config) error {
 		return fmt.Errorf("font cannot be nil")
 	}
 
+	if config.MinDensity > 0 {
+		if d, ok := config.Density(); ok && d < config.MinDensity {
+			return fmt.Errorf("watermark density %.2f is below the required minimum of %.2f, use a larger size or smaller spacing", d, config.MinDensity)
+		}
+	}
+
+	if uncovered := UncoveredRunes(config); len(uncovered) > 0 {
+		logrus.WithField("characters", string(uncovered)).Warn("No configured font covers some watermark characters, they will render as boxes")
+	}
+
+	for _, redaction := range config.Redactions {
+		if err := redaction.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if config.MaxDimension < 0 {
+		return fmt.Errorf("max dimension cannot be negative, got: %d", config.MaxDimension)
+	}
+
+	if config.TargetDPI < 0 {
+		return fmt.Errorf("target DPI cannot be negative, got: %.1f", config.TargetDPI)
+	}
+
+	if config.DebugOutline && len(config.Redactions) > 0 {
+		return fmt.Errorf("debug outline cannot be combined with redactions, it would contain unredacted pixels")
+	}
+
 	return nil
 }